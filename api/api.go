@@ -7,7 +7,10 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"nhooyr.io/websocket"
 )
@@ -24,11 +27,25 @@ type API struct {
 	// Token is the Rendezvous token we receive after logging in.
 	// This must be set, or will be set with a call to Login.
 	//
-	// Token must not change once set.
+	// Token must not be changed directly once the API is in use, as it may
+	// be replaced at any time when Credentials is set.
+	// Use CurrentToken to read it.
 	Token string
 
+	// Credentials is used to fetch a new token when the Rendezvous server
+	// rejects the current one.
+	// If nil, requests made with a bad token simply fail.
+	Credentials Credentials
+
+	// OnToken is called whenever the token changes through Login or
+	// Credentials, so that it may be saved.
+	OnToken func(token string)
+
 	HTTP *http.Client
 
+	tokenLock   sync.RWMutex
+	refreshLock sync.Mutex
+
 	ws     *websocket.Conn
 	wsLock sync.Mutex
 }
@@ -52,16 +69,87 @@ const (
 	EndpointPunch   Endpoint = "/punch"
 )
 
+// Errors that an *Error may be compared to with errors.Is.
 var (
-	ErrNotFound = httpError(404)
+	ErrUnauthorized = httpError(http.StatusUnauthorized)
+	ErrForbidden    = httpError(http.StatusForbidden)
+	ErrNotFound     = httpError(http.StatusNotFound)
+	ErrConflict     = httpError(http.StatusConflict)
+	ErrRateLimited  = httpError(http.StatusTooManyRequests)
 )
 
+// maxErrorSize is the most of an error response body that will be read.
+const maxErrorSize = 4096
+
 func (h httpError) Error() string {
 	return fmt.Sprintf("http status code %3d", h)
 }
 
-func readError(res *http.Response) error {
-	return httpError(res.StatusCode)
+// Error is returned when the Rendezvous server responds to a request with an
+// error.
+//
+// Use errors.Is with ErrUnauthorized, ErrForbidden, ErrNotFound, ErrConflict
+// or ErrRateLimited to check for specific conditions.
+type Error struct {
+	// StatusCode is the HTTP status code of the response.
+	StatusCode int
+
+	// Method and Endpoint describe the request that failed.
+	Method   string
+	Endpoint Endpoint
+
+	// Message is the error message sent by the server, if any.
+	Message string
+
+	// RetryAfter is how long the server asked us to wait before trying
+	// again, if it did.
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	msg := e.Message
+	if msg == "" {
+		msg = http.StatusText(e.StatusCode)
+	}
+
+	return fmt.Sprintf("%s %s: %s (http status code %3d)", e.Method, e.Endpoint, msg, e.StatusCode)
+}
+
+// Is allows comparing an *Error to ErrNotFound and friends.
+func (e *Error) Is(target error) bool {
+	h, ok := target.(httpError)
+	return ok && int(h) == e.StatusCode
+}
+
+// readError converts an unsuccessful response into an *Error.
+func readError(res *http.Response, method string, ep Endpoint) error {
+	e := &Error{
+		StatusCode: res.StatusCode,
+		Method:     method,
+		Endpoint:   ep,
+	}
+
+	if secs, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil && secs >= 0 {
+		e.RetryAfter = time.Duration(secs) * time.Second
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(res.Body, maxErrorSize))
+
+	// The server normally sends {"error": "..."}, but be lenient.
+	msg := struct {
+		Error   string `json:"error"`
+		Message string `json:"message"`
+	}{}
+	if err := json.Unmarshal(body, &msg); err == nil {
+		e.Message = msg.Error
+		if e.Message == "" {
+			e.Message = msg.Message
+		}
+	} else if strings.HasPrefix(res.Header.Get("Content-Type"), "text/plain") {
+		e.Message = strings.TrimSpace(string(body))
+	}
+
+	return e
 }
 
 func (a *API) Endpoint(ep Endpoint) string {
@@ -69,49 +157,92 @@ func (a *API) Endpoint(ep Endpoint) string {
 	return a.Server + string(ep)
 }
 
-func encodeJSON(data any) (io.Reader, error) {
-	b := &bytes.Buffer{}
-	if err := json.NewEncoder(b).Encode(data); err != nil {
+// newRequest creates a new request to an endpoint with the current token.
+func (a *API) newRequest(ctx context.Context, method string, ep Endpoint, body []byte, q []any) (*http.Request, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, a.Endpoint(ep), r)
+	if err != nil {
 		return nil, err
 	}
-	return b, nil
+
+	qe := req.URL.Query()
+	for len(q) != 0 {
+		k, v := fmt.Sprint(q[0]), fmt.Sprint(q[1])
+		q = q[2:]
+
+		qe.Set(k, v)
+	}
+	req.URL.RawQuery = qe.Encode()
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Authorization", "Bearer "+a.CurrentToken())
+
+	return req, nil
 }
 
-// abuses generics to generate code for responses that just return JSON data
-func makeGetJSONResp[T any](ep Endpoint) func(a *API, ctx context.Context, q ...any) (T, error) {
-	return func(a *API, ctx context.Context, q ...any) (T, error) {
-		var data T
+// do performs a request.
+//
+// If the server rejects our token and Credentials is set, a new token is
+// requested and the request is tried once more.
+func (a *API) do(ctx context.Context, method string, ep Endpoint, body []byte, q []any) (*http.Response, error) {
+	req, err := a.newRequest(ctx, method, ep, body, q)
+	if err != nil {
+		return nil, err
+	}
 
-		req, err := http.NewRequestWithContext(ctx, "GET", a.Endpoint(ep), nil)
-		if err != nil {
-			return data, err
-		}
+	token := a.CurrentToken()
 
-		qe := req.URL.Query()
-		for len(q) != 0 {
-			k, v := fmt.Sprint(q[0]), fmt.Sprint(q[1])
-			q = q[2:]
+	res, err := a.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	} else if res.StatusCode != http.StatusUnauthorized || a.Credentials == nil || ep == EndpointAuth {
+		return res, nil
+	}
 
-			qe.Set(k, v)
-		}
-		req.URL.RawQuery = qe.Encode()
+	res.Body.Close()
+
+	if err := a.refresh(ctx, token); err != nil {
+		return nil, err
+	}
+
+	if req, err = a.newRequest(ctx, method, ep, body, q); err != nil {
+		return nil, err
+	}
+
+	return a.HTTP.Do(req)
+}
+
+// decodeResponse decodes a JSON response, or returns the error the server sent.
+func decodeResponse[T any](res *http.Response, method string, ep Endpoint) (T, error) {
+	var data T
+	defer res.Body.Close()
+
+	if res.StatusCode == 204 {
+		return data, nil
+	} else if res.StatusCode != 200 {
+		return data, readError(res, method, ep)
+	}
 
-		req.Header.Set("Authorization", "Bearer "+a.Token)
+	err := json.NewDecoder(res.Body).Decode(&data)
+	return data, err
+}
 
-		res, err := a.HTTP.Do(req)
+// abuses generics to generate code for responses that just return JSON data
+func makeGetJSONResp[T any](ep Endpoint) func(a *API, ctx context.Context, q ...any) (T, error) {
+	return func(a *API, ctx context.Context, q ...any) (T, error) {
+		res, err := a.do(ctx, "GET", ep, nil, q)
 		if err != nil {
+			var data T
 			return data, err
 		}
-		defer res.Body.Close()
 
-		if res.StatusCode == 204 {
-			return data, nil
-		} else if res.StatusCode != 200 {
-			return data, readError(res)
-		}
-
-		err = json.NewDecoder(res.Body).Decode(&data)
-		return data, err
+		return decodeResponse[T](res, "GET", ep)
 	}
 }
 
@@ -119,42 +250,17 @@ func makePostJSONResp[T any, R any](ep Endpoint) func(a *API, ctx context.Contex
 	return func(a *API, ctx context.Context, bodyData T, q ...any) (R, error) {
 		var data R
 
-		body, err := encodeJSON(bodyData)
-		if err != nil {
-			return data, err
-		}
-
-		req, err := http.NewRequestWithContext(ctx, "POST", a.Endpoint(ep), body)
+		body, err := json.Marshal(bodyData)
 		if err != nil {
 			return data, err
 		}
 
-		qe := req.URL.Query()
-		for len(q) != 0 {
-			k, v := fmt.Sprint(q[0]), fmt.Sprint(q[1])
-			q = q[2:]
-
-			qe.Set(k, v)
-		}
-		req.URL.RawQuery = qe.Encode()
-
-		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("Authorization", "Bearer "+a.Token)
-
-		res, err := a.HTTP.Do(req)
+		res, err := a.do(ctx, "POST", ep, body, q)
 		if err != nil {
 			return data, err
 		}
-		defer res.Body.Close()
-
-		if res.StatusCode == 204 {
-			return data, nil
-		} else if res.StatusCode != 200 {
-			return data, readError(res)
-		}
 
-		err = json.NewDecoder(res.Body).Decode(&data)
-		return data, err
+		return decodeResponse[R](res, "POST", ep)
 	}
 }
 
@@ -204,7 +310,7 @@ func (a *API) Login(ctx context.Context, username, password string) error {
 	if err != nil {
 		return err
 	}
-	a.Token = resp.Token
+	a.setToken(resp.Token)
 	return nil
 }
 
@@ -0,0 +1,93 @@
+package api_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/mca3/pikonode/api"
+	"github.com/mca3/pikonode/api/apitest"
+)
+
+func TestErrors(t *testing.T) {
+	srv := apitest.NewServer()
+	defer srv.Close()
+
+	alice, token := srv.AddUser("alice", "hunter2")
+	bob, _ := srv.AddUser("bob", "correct horse")
+	dev := srv.AddDevice(alice.ID, "laptop", "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=")
+	other := srv.AddDevice(bob.ID, "desktop", "BAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=")
+
+	ctx := context.Background()
+	a := srv.Client(token)
+
+	tests := []struct {
+		name   string
+		err    error
+		target error
+		status int
+	}{
+		{"not found", func() error { _, err := a.Device(ctx, 9999); return err }(), api.ErrNotFound, 404},
+		{"forbidden", func() error { _, err := a.Device(ctx, other.ID); return err }(), api.ErrForbidden, 403},
+		{"conflict", func() error { _, err := a.NewDevice(ctx, "dup", dev.PublicKey); return err }(), api.ErrConflict, 409},
+		{"unauthorized", func() error { _, err := srv.Client("nope").Devices(ctx); return err }(), api.ErrUnauthorized, 401},
+	}
+
+	for _, v := range tests {
+		t.Run(v.name, func(t *testing.T) {
+			if !errors.Is(v.err, v.target) {
+				t.Fatalf("err = %v, expected %v", v.err, v.target)
+			}
+
+			aerr := &api.Error{}
+			if !errors.As(v.err, &aerr) {
+				t.Fatalf("err is %T, expected *api.Error", v.err)
+			}
+
+			if aerr.StatusCode != v.status || aerr.Message == "" || aerr.Method == "" || aerr.Endpoint == "" {
+				t.Errorf("got %+v, expected status %d with method, endpoint and message", aerr, v.status)
+			}
+		})
+	}
+}
+
+func TestTokenRefresh(t *testing.T) {
+	srv := apitest.NewServer()
+	defer srv.Close()
+
+	alice, token := srv.AddUser("alice", "hunter2")
+	srv.AddDevice(alice.ID, "laptop", "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=")
+
+	ctx := context.Background()
+
+	a := srv.Client(token)
+	b := srv.Client(token)
+
+	saved := ""
+	a.Credentials = api.PasswordCredentials{Username: "alice", Password: "hunter2"}
+	a.OnToken = func(token string) { saved = token }
+
+	newToken := srv.ExpireToken(alice.ID)
+
+	if _, err := b.Devices(ctx); !errors.Is(err, api.ErrUnauthorized) {
+		t.Fatalf("err = %v without credentials, expected %v", err, api.ErrUnauthorized)
+	}
+
+	devs, err := a.Devices(ctx)
+	if err != nil {
+		t.Fatalf("failed to list devices: %v", err)
+	} else if len(devs) != 1 {
+		t.Fatalf("got %d devices, expected 1", len(devs))
+	}
+
+	if saved != newToken || a.CurrentToken() != newToken {
+		t.Errorf("token is %q, saved %q, expected %q", a.CurrentToken(), saved, newToken)
+	}
+
+	a.Credentials = api.PasswordCredentials{Username: "alice", Password: "wrong"}
+	srv.ExpireToken(alice.ID)
+
+	if _, err := a.Devices(ctx); !errors.Is(err, api.ErrUnauthorized) {
+		t.Errorf("err = %v with bad credentials, expected %v", err, api.ErrUnauthorized)
+	}
+}
@@ -0,0 +1,794 @@
+// Package apitest implements a fake Rendezvous server for use in tests.
+//
+// The server keeps all of its state in memory and speaks the same REST and
+// gateway protocol that the api package does, so an api.API can be pointed at
+// it directly.
+// Tests may change the state of the server at any time, and the appropriate
+// gateway messages are sent to every connected client.
+package apitest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mca3/pikonode/api"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+// Server is a fake Rendezvous server.
+type Server struct {
+	// Punch is returned by the Pikopunch endpoint.
+	Punch api.PunchDetails
+
+	srv *httptest.Server
+
+	users    map[int64]*user
+	devices  map[int64]*api.Device
+	networks map[int64]*network
+	gateways map[*gateway]struct{}
+	lastID   int64
+	serial   int64
+	mu       sync.Mutex
+}
+
+type user struct {
+	api.User
+	Password string
+	Token    string
+}
+
+type network struct {
+	api.Network
+	Members []int64
+}
+
+type gateway struct {
+	conn   *websocket.Conn
+	user   int64
+	device int64
+
+	// queue holds messages that have yet to be written, so that they are
+	// sent in order without blocking the server.
+	queue  []api.GatewayMsg
+	closed bool
+	cond   *sync.Cond
+	mu     sync.Mutex
+}
+
+// njl mirrors the body of join and leave requests.
+type njl struct {
+	Device  int64
+	Network int64
+}
+
+// NewServer starts a new fake Rendezvous server.
+//
+// The server must be closed with Close.
+func NewServer() *Server {
+	s := &Server{
+		users:    map[int64]*user{},
+		devices:  map[int64]*api.Device{},
+		networks: map[int64]*network{},
+		gateways: map[*gateway]struct{}{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(string(api.EndpointAuth), s.handleAuth)
+	mux.HandleFunc(string(api.EndpointListDevices), s.authed(s.handleListDevices))
+	mux.HandleFunc(string(api.EndpointListNetworks), s.authed(s.handleListNetworks))
+	mux.HandleFunc(string(api.EndpointNewDevice), s.authed(s.handleNewDevice))
+	mux.HandleFunc(string(api.EndpointNewNetwork), s.authed(s.handleNewNetwork))
+	mux.HandleFunc(string(api.EndpointNetworkInfo), s.authed(s.handleNetworkInfo))
+	mux.HandleFunc(string(api.EndpointDeviceInfo), s.authed(s.handleDeviceInfo))
+	mux.HandleFunc(string(api.EndpointDeviceJoin), s.authed(s.handleJoin))
+	mux.HandleFunc(string(api.EndpointDeviceLeave), s.authed(s.handleLeave))
+	mux.HandleFunc(string(api.EndpointPunch), s.authed(s.handlePunch))
+	mux.HandleFunc(string(api.EndpointGateway), s.authed(s.handleGateway))
+
+	s.srv = httptest.NewServer(mux)
+	return s
+}
+
+// URL returns the URL that api.API.Server should be set to.
+func (s *Server) URL() string {
+	return s.srv.URL
+}
+
+// Client returns an api.API that is logged in with the specified token.
+func (s *Server) Client(token string) *api.API {
+	return &api.API{
+		Server: s.URL(),
+		Token:  token,
+		HTTP:   s.srv.Client(),
+	}
+}
+
+// Close shuts down the server and disconnects all clients.
+func (s *Server) Close() {
+	s.DisconnectGateways()
+	s.srv.Close()
+}
+
+// nextID returns a new unique ID.
+//
+// s.mu must be held.
+func (s *Server) nextID() int64 {
+	s.lastID++
+	return s.lastID
+}
+
+// AddUser creates a new user, returning it and a valid token for it.
+func (s *Server) AddUser(username, password string) (api.User, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := s.nextID()
+	u := &user{
+		User: api.User{
+			ID:       id,
+			Username: username,
+			Email:    username + "@example.com",
+		},
+		Password: password,
+	}
+	s.users[id] = u
+	s.newToken(u)
+
+	return u.User, u.Token
+}
+
+// ExpireToken invalidates the token of a user, returning a new one.
+func (s *Server) ExpireToken(uid int64) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if u, ok := s.users[uid]; ok {
+		return s.newToken(u)
+	}
+	return ""
+}
+
+// newToken assigns a new token to a user.
+//
+// s.mu must be held.
+func (s *Server) newToken(u *user) string {
+	s.serial++
+	u.Token = fmt.Sprintf("token-%d-%d", u.ID, s.serial)
+	return u.Token
+}
+
+// AddDevice creates a new device owned by the specified user.
+//
+// Devices are assigned an IP based on their ID in fd00::/32.
+func (s *Server) AddDevice(owner int64, name, key string) api.Device {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.addDevice(owner, name, key)
+}
+
+func (s *Server) addDevice(owner int64, name, key string) api.Device {
+	id := s.nextID()
+	d := &api.Device{
+		ID:        id,
+		Owner:     owner,
+		Name:      name,
+		PublicKey: key,
+		IP:        fmt.Sprintf("fd00::%x", id),
+	}
+	s.devices[id] = d
+
+	return *d
+}
+
+// AddNetwork creates a new network owned by the specified user.
+func (s *Server) AddNetwork(owner int64, name string) api.Network {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.addNetwork(owner, name)
+}
+
+func (s *Server) addNetwork(owner int64, name string) api.Network {
+	id := s.nextID()
+	nw := &network{Network: api.Network{ID: id, Owner: owner, Name: name}}
+	s.networks[id] = nw
+
+	return s.network(nw)
+}
+
+// Device returns the current state of a device.
+func (s *Server) Device(id int64) (api.Device, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, ok := s.devices[id]
+	if !ok {
+		return api.Device{}, false
+	}
+	return s.device(d), true
+}
+
+// Network returns the current state of a network.
+func (s *Server) Network(id int64) (api.Network, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	nw, ok := s.networks[id]
+	if !ok {
+		return api.Network{}, false
+	}
+	return s.network(nw), true
+}
+
+// Join adds a device to a network, sending NetworkJoin to all gateways.
+func (s *Server) Join(dev, nw int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.join(dev, nw)
+}
+
+func (s *Server) join(dev, nwid int64) error {
+	d, nw := s.devices[dev], s.networks[nwid]
+	if d == nil || nw == nil {
+		return fmt.Errorf("device %d or network %d does not exist", dev, nwid)
+	}
+
+	for _, v := range nw.Members {
+		if v == dev {
+			return nil
+		}
+	}
+	nw.Members = append(nw.Members, dev)
+
+	apiNw, apiDev := s.network(nw), *d
+	s.broadcast(api.GatewayMsg{Type: api.NetworkJoin, Network: &apiNw, Device: &apiDev})
+	return nil
+}
+
+// Leave removes a device from a network, sending NetworkLeave to all
+// gateways.
+func (s *Server) Leave(dev, nw int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.leave(dev, nw)
+}
+
+func (s *Server) leave(dev, nwid int64) error {
+	d, nw := s.devices[dev], s.networks[nwid]
+	if d == nil || nw == nil {
+		return fmt.Errorf("device %d or network %d does not exist", dev, nwid)
+	}
+
+	for i, v := range nw.Members {
+		if v == dev {
+			nw.Members = append(nw.Members[:i], nw.Members[i+1:]...)
+			break
+		}
+	}
+
+	apiNw, apiDev := s.network(nw), *d
+	s.broadcast(api.GatewayMsg{Type: api.NetworkLeave, Network: &apiNw, Device: &apiDev})
+	return nil
+}
+
+// UpdateDevice replaces the details of a device, sending DeviceUpdate to all
+// gateways.
+//
+// The ID and owner of the device cannot be changed.
+func (s *Server) UpdateDevice(dev api.Device) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, ok := s.devices[dev.ID]
+	if !ok {
+		return fmt.Errorf("device %d does not exist", dev.ID)
+	}
+
+	dev.Owner = d.Owner
+	dev.Networks = nil
+	*d = dev
+
+	apiDev := *d
+	s.broadcast(api.GatewayMsg{Type: api.DeviceUpdate, Device: &apiDev})
+	return nil
+}
+
+// Send sends an arbitrary message to all gateways.
+func (s *Server) Send(msg api.GatewayMsg) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.broadcast(msg)
+}
+
+// Gateways returns the number of gateway connections.
+func (s *Server) Gateways() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.gateways)
+}
+
+// WaitGateways blocks until there are at least n gateway connections, or the
+// context expires.
+func (s *Server) WaitGateways(ctx context.Context, n int) error {
+	t := time.NewTicker(time.Millisecond * 10)
+	defer t.Stop()
+
+	for s.Gateways() < n {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+
+	return nil
+}
+
+// DisconnectGateways closes all gateway connections.
+//
+// Clients are free to reconnect.
+func (s *Server) DisconnectGateways() {
+	s.mu.Lock()
+	gws := make([]*gateway, 0, len(s.gateways))
+	for gw := range s.gateways {
+		gws = append(gws, gw)
+	}
+	s.mu.Unlock()
+
+	for _, gw := range gws {
+		gw.conn.Close(websocket.StatusGoingAway, "disconnected by test")
+	}
+}
+
+// device returns a copy of a device with its networks filled in.
+//
+// s.mu must be held.
+func (s *Server) device(d *api.Device) api.Device {
+	dev := *d
+	dev.Networks = nil
+
+	for _, nw := range s.networks {
+		for _, v := range nw.Members {
+			if v == d.ID {
+				dev.Networks = append(dev.Networks, nw.Network)
+				break
+			}
+		}
+	}
+
+	sortNetworks(dev.Networks)
+	return dev
+}
+
+// network returns a copy of a network with its devices filled in.
+//
+// s.mu must be held.
+func (s *Server) network(nw *network) api.Network {
+	n := nw.Network
+	n.Devices = make([]api.Device, 0, len(nw.Members))
+
+	for _, v := range nw.Members {
+		n.Devices = append(n.Devices, *s.devices[v])
+	}
+
+	return n
+}
+
+// canSee determines if a user may look at a device.
+//
+// A user may look at any device they own, and any device in a network that
+// one of their devices is in.
+//
+// s.mu must be held.
+func (s *Server) canSee(uid int64, d *api.Device) bool {
+	if d.Owner == uid {
+		return true
+	}
+
+	for _, nw := range s.networks {
+		if s.inNetwork(uid, nw) && contains(nw.Members, d.ID) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// inNetwork determines if the user owns the network or has a device in it.
+//
+// s.mu must be held.
+func (s *Server) inNetwork(uid int64, nw *network) bool {
+	if nw.Owner == uid {
+		return true
+	}
+
+	for _, v := range nw.Members {
+		if s.devices[v].Owner == uid {
+			return true
+		}
+	}
+
+	return false
+}
+
+// broadcast sends a message to every gateway.
+//
+// s.mu must be held.
+func (s *Server) broadcast(msg api.GatewayMsg) {
+	for gw := range s.gateways {
+		gw.mu.Lock()
+		gw.queue = append(gw.queue, msg)
+		gw.cond.Signal()
+		gw.mu.Unlock()
+	}
+}
+
+// writeLoop writes queued messages to the gateway until it is closed.
+func (gw *gateway) writeLoop(ctx context.Context) {
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+
+	for {
+		for len(gw.queue) == 0 && !gw.closed {
+			gw.cond.Wait()
+		}
+
+		if gw.closed {
+			return
+		}
+
+		msg := gw.queue[0]
+		gw.queue = gw.queue[1:]
+
+		gw.mu.Unlock()
+		err := wsjson.Write(ctx, gw.conn, msg)
+		gw.mu.Lock()
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// close stops the write loop.
+func (gw *gateway) close() {
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+
+	gw.closed = true
+	gw.cond.Signal()
+}
+
+func sortDevices(l []api.Device) {
+	sort.Slice(l, func(i, j int) bool { return l[i].ID < l[j].ID })
+}
+
+func sortNetworks(l []api.Network) {
+	sort.Slice(l, func(i, j int) bool { return l[i].ID < l[j].ID })
+}
+
+func contains(l []int64, id int64) bool {
+	for _, v := range l {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+// writeJSON writes a JSON response.
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes an error response in the same format as the Rendezvous
+// server.
+func writeError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+// queryID fetches the "id" query parameter.
+func queryID(r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	return id, err == nil
+}
+
+// authed wraps a handler with authentication.
+func (s *Server) authed(h func(w http.ResponseWriter, r *http.Request, u *user)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			writeError(w, http.StatusUnauthorized, "missing token")
+			return
+		}
+
+		s.mu.Lock()
+		var u *user
+		for _, v := range s.users {
+			if v.Token == token {
+				u = v
+				break
+			}
+		}
+		s.mu.Unlock()
+
+		if u == nil {
+			writeError(w, http.StatusUnauthorized, "invalid token")
+			return
+		}
+
+		h(w, r, u)
+	}
+}
+
+// method rejects requests made with the wrong method.
+func method(w http.ResponseWriter, r *http.Request, m string) bool {
+	if r.Method != m {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return false
+	}
+	return true
+}
+
+func (s *Server) handleAuth(w http.ResponseWriter, r *http.Request) {
+	if !method(w, r, http.MethodPost) {
+		return
+	}
+
+	body := struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Method   string `json:"method"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "malformed body")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, v := range s.users {
+		if v.Username == body.Username && v.Password == body.Password {
+			writeJSON(w, map[string]string{"token": v.Token})
+			return
+		}
+	}
+
+	writeError(w, http.StatusUnauthorized, "invalid username or password")
+}
+
+func (s *Server) handleListDevices(w http.ResponseWriter, r *http.Request, u *user) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	devs := []api.Device{}
+	for _, v := range s.devices {
+		if v.Owner == u.ID {
+			devs = append(devs, s.device(v))
+		}
+	}
+
+	sortDevices(devs)
+	writeJSON(w, devs)
+}
+
+func (s *Server) handleListNetworks(w http.ResponseWriter, r *http.Request, u *user) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	nws := []api.Network{}
+	for _, v := range s.networks {
+		if s.inNetwork(u.ID, v) {
+			nws = append(nws, s.network(v))
+		}
+	}
+
+	sortNetworks(nws)
+	writeJSON(w, nws)
+}
+
+func (s *Server) handleNewDevice(w http.ResponseWriter, r *http.Request, u *user) {
+	if !method(w, r, http.MethodPost) {
+		return
+	}
+
+	body := api.Device{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "malformed body")
+		return
+	} else if body.Name == "" || body.PublicKey == "" {
+		writeError(w, http.StatusBadRequest, "name and key are required")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, v := range s.devices {
+		if v.PublicKey == body.PublicKey {
+			writeError(w, http.StatusConflict, "a device with this key already exists")
+			return
+		}
+	}
+
+	writeJSON(w, s.addDevice(u.ID, body.Name, body.PublicKey))
+}
+
+func (s *Server) handleNewNetwork(w http.ResponseWriter, r *http.Request, u *user) {
+	if !method(w, r, http.MethodPost) {
+		return
+	}
+
+	body := api.Network{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "malformed body")
+		return
+	} else if body.Name == "" {
+		writeError(w, http.StatusBadRequest, "name is required")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	writeJSON(w, s.addNetwork(u.ID, body.Name))
+}
+
+func (s *Server) handleNetworkInfo(w http.ResponseWriter, r *http.Request, u *user) {
+	id, ok := queryID(r)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "invalid id")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	nw, ok := s.networks[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "network not found")
+		return
+	} else if !s.inNetwork(u.ID, nw) {
+		writeError(w, http.StatusForbidden, "you may not view this network")
+		return
+	}
+
+	writeJSON(w, s.network(nw))
+}
+
+func (s *Server) handleDeviceInfo(w http.ResponseWriter, r *http.Request, u *user) {
+	id, ok := queryID(r)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "invalid id")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, ok := s.devices[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "device not found")
+		return
+	} else if !s.canSee(u.ID, d) {
+		writeError(w, http.StatusForbidden, "you may not view this device")
+		return
+	}
+
+	writeJSON(w, s.device(d))
+}
+
+// handleMembership handles joins and leaves.
+func (s *Server) handleMembership(w http.ResponseWriter, r *http.Request, u *user, f func(dev, nw int64) error) {
+	if !method(w, r, http.MethodPost) {
+		return
+	}
+
+	body := njl{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "malformed body")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, nw := s.devices[body.Device], s.networks[body.Network]
+	if d == nil || nw == nil {
+		writeError(w, http.StatusNotFound, "device or network not found")
+		return
+	} else if d.Owner != u.ID || nw.Owner != u.ID {
+		writeError(w, http.StatusForbidden, "you do not own this device or network")
+		return
+	}
+
+	if err := f(body.Device, body.Network); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleJoin(w http.ResponseWriter, r *http.Request, u *user) {
+	s.handleMembership(w, r, u, s.join)
+}
+
+func (s *Server) handleLeave(w http.ResponseWriter, r *http.Request, u *user) {
+	s.handleMembership(w, r, u, s.leave)
+}
+
+func (s *Server) handlePunch(w http.ResponseWriter, r *http.Request, u *user) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	writeJSON(w, s.Punch)
+}
+
+func (s *Server) handleGateway(w http.ResponseWriter, r *http.Request, u *user) {
+	conn, err := websocket.Accept(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	gw := &gateway{conn: conn, user: u.ID}
+	gw.cond = sync.NewCond(&gw.mu)
+
+	s.mu.Lock()
+	s.gateways[gw] = struct{}{}
+	s.mu.Unlock()
+
+	go gw.writeLoop(r.Context())
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.gateways, gw)
+		s.mu.Unlock()
+
+		gw.close()
+		conn.Close(websocket.StatusNormalClosure, "")
+	}()
+
+	for {
+		msg := api.GatewayMsg{}
+		if err := wsjson.Read(r.Context(), conn, &msg); err != nil {
+			return
+		}
+
+		if msg.Type != api.Ping {
+			continue
+		}
+
+		s.mu.Lock()
+		d, ok := s.devices[msg.DeviceID]
+		if ok && d.Owner == u.ID {
+			gw.device = d.ID
+
+			if msg.Endpoint != "" && msg.Endpoint != d.Endpoint {
+				d.Endpoint = msg.Endpoint
+
+				apiDev := *d
+				s.broadcast(api.GatewayMsg{Type: api.DeviceUpdate, Device: &apiDev})
+			}
+		}
+		s.mu.Unlock()
+	}
+}
@@ -0,0 +1,76 @@
+package api
+
+import (
+	"context"
+	"fmt"
+)
+
+// Credentials is a source of new tokens for an API.
+type Credentials interface {
+	// Token is called after the Rendezvous server has rejected the
+	// current token, and returns a new one.
+	Token(ctx context.Context, a *API) (string, error)
+}
+
+// CredentialsFunc is a function that implements Credentials.
+type CredentialsFunc func(ctx context.Context, a *API) (string, error)
+
+// Token calls f.
+func (f CredentialsFunc) Token(ctx context.Context, a *API) (string, error) {
+	return f(ctx, a)
+}
+
+// PasswordCredentials fetches new tokens by logging in again.
+type PasswordCredentials struct {
+	Username string
+	Password string
+}
+
+// Token logs in with the username and password.
+func (p PasswordCredentials) Token(ctx context.Context, a *API) (string, error) {
+	resp, err := login(a, ctx, loginData{p.Username, p.Password, "username-password"})
+	if err != nil {
+		return "", err
+	}
+	return resp.Token, nil
+}
+
+// CurrentToken returns the token that is currently in use.
+func (a *API) CurrentToken() string {
+	a.tokenLock.RLock()
+	defer a.tokenLock.RUnlock()
+
+	return a.Token
+}
+
+// setToken replaces the token and lets OnToken know about it.
+func (a *API) setToken(token string) {
+	a.tokenLock.Lock()
+	a.Token = token
+	a.tokenLock.Unlock()
+
+	if a.OnToken != nil {
+		a.OnToken(token)
+	}
+}
+
+// refresh fetches a new token from Credentials, replacing old.
+//
+// If the token has already been replaced by the time refresh is called, which
+// happens when several requests fail at once, nothing is done.
+func (a *API) refresh(ctx context.Context, old string) error {
+	a.refreshLock.Lock()
+	defer a.refreshLock.Unlock()
+
+	if a.CurrentToken() != old {
+		return nil
+	}
+
+	token, err := a.Credentials.Token(ctx, a)
+	if err != nil {
+		return fmt.Errorf("failed to refresh token: %w", err)
+	}
+
+	a.setToken(token)
+	return nil
+}
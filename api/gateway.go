@@ -2,6 +2,7 @@ package api
 
 import (
 	"context"
+	"errors"
 	"math"
 	"net/http"
 	"time"
@@ -37,16 +38,35 @@ const (
 	Connect    gatewayMsgType = -2
 )
 
-func (a *API) dialGateway(ctx context.Context) (*websocket.Conn, error) {
-	c, _, err := websocket.Dial(ctx, a.Endpoint(EndpointGateway), &websocket.DialOptions{
+func (a *API) dialGatewayOnce(ctx context.Context) (*websocket.Conn, error) {
+	c, res, err := websocket.Dial(ctx, a.Endpoint(EndpointGateway), &websocket.DialOptions{
 		HTTPClient: a.HTTP,
 		HTTPHeader: http.Header{
-			"Authorization": []string{"Bearer " + a.Token},
+			"Authorization": []string{"Bearer " + a.CurrentToken()},
 		},
 	})
+	if err != nil && res != nil && res.StatusCode >= 400 {
+		return nil, readError(res, http.MethodGet, EndpointGateway)
+	}
 	return c, err
 }
 
+func (a *API) dialGateway(ctx context.Context) (*websocket.Conn, error) {
+	token := a.CurrentToken()
+
+	c, err := a.dialGatewayOnce(ctx)
+	if !errors.Is(err, ErrUnauthorized) || a.Credentials == nil {
+		return c, err
+	}
+
+	// Our token was rejected; try again with a new one.
+	if err := a.refresh(ctx, token); err != nil {
+		return nil, err
+	}
+
+	return a.dialGatewayOnce(ctx)
+}
+
 func (a *API) gwReadLoop(ctx context.Context, conn *websocket.Conn, c chan<- GatewayMsg) error {
 	for {
 		msg := GatewayMsg{}
@@ -118,6 +138,7 @@ func (a *API) Gateway(ctx context.Context, c chan<- GatewayMsg, dev int64, port
 			if conn != nil {
 				conn.Close(websocket.StatusNormalClosure, "closing")
 			}
+			a.wsLock.Unlock()
 			return
 		case <-t.C:
 			continue
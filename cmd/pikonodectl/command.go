@@ -0,0 +1,318 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/mca3/pikonode/internal/config"
+)
+
+// Exit codes.
+const (
+	exitFailure = 1
+	exitUsage   = 2
+)
+
+// command is a pikonodectl subcommand.
+//
+// A command either has subcommands or a Run function, but not both.
+type command struct {
+	Name    string
+	Aliases []string
+
+	// Args describes the positional arguments, and Short describes what
+	// the command does; both are used in help.
+	// Long is printed after Short in help, if set.
+	Args  string
+	Short string
+	Long  string
+
+	// MinArgs and MaxArgs are the number of positional arguments that are
+	// accepted. MaxArgs is unlimited if negative.
+	MinArgs, MaxArgs int
+
+	// Choices lists the values that positional arguments may take, for
+	// shell completion.
+	Choices []string
+
+	// Flags registers flags specific to this command.
+	Flags func(fs *flag.FlagSet)
+
+	// Run runs the command with its positional arguments, which have
+	// already been checked against MinArgs and MaxArgs.
+	Run func(args []string)
+
+	// NoConfig is set for commands that do not need the config file or
+	// the Rendezvous server.
+	NoConfig bool
+
+	Sub []*command
+
+	parent *command
+}
+
+// showHelp is set by --help.
+var showHelp bool
+
+// shortFlags and longFlags map between the long and short names of flags that
+// have both.
+var (
+	shortFlags = map[string]string{}
+	longFlags  = map[string]string{}
+)
+
+// alias registers short as another name for the flag long.
+func alias(fs *flag.FlagSet, short, long string) {
+	f := fs.Lookup(long)
+	fs.Var(f.Value, short, f.Usage)
+
+	shortFlags[long] = short
+	longFlags[short] = long
+}
+
+// globalFlags registers the flags that every command accepts.
+func globalFlags(fs *flag.FlagSet) {
+	fs.Var(&output, "output", "`format` to print results in: table, json or yaml")
+	alias(fs, "o", "output")
+
+	fs.StringVar(&config.ConfigFileOverride, "config", config.ConfigFileOverride, "`path` of the config file to use")
+	alias(fs, "c", "config")
+
+	fs.StringVar(&config.Profile, "profile", config.Profile, "`name` of the profile to use")
+	alias(fs, "p", "profile")
+
+	fs.BoolVar(&showHelp, "help", false, "show help")
+	alias(fs, "h", "help")
+}
+
+// link sets the parent of every subcommand in the tree.
+func (c *command) link() *command {
+	for _, v := range c.Sub {
+		v.parent = c
+		v.link()
+	}
+	return c
+}
+
+// path returns the full name of the command, e.g. "pikonodectl new device".
+func (c *command) path() string {
+	if c.parent == nil {
+		return c.Name
+	}
+	return c.parent.path() + " " + c.Name
+}
+
+// find returns the subcommand with the specified name or alias.
+func (c *command) find(name string) *command {
+	for _, v := range c.Sub {
+		if v.Name == name {
+			return v
+		}
+
+		for _, a := range v.Aliases {
+			if a == name {
+				return v
+			}
+		}
+	}
+	return nil
+}
+
+// flagSet returns a FlagSet holding the global flags and those of c.
+func (c *command) flagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet(c.path(), flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+
+	globalFlags(fs)
+	if c.Flags != nil {
+		c.Flags(fs)
+	}
+
+	return fs
+}
+
+// synopsis returns a one line summary of how to use c.
+func (c *command) synopsis() string {
+	s := c.path() + " [options]"
+	if len(c.Sub) != 0 {
+		s += " <command>"
+	}
+	if c.Args != "" {
+		s += " " + c.Args
+	}
+	return s
+}
+
+// help writes the help for c.
+func (c *command) help(w io.Writer) {
+	fmt.Fprintf(w, "usage: %s\n", c.synopsis())
+	if c.Short != "" {
+		fmt.Fprintf(w, "\n%s\n", c.Short)
+	}
+	if c.Long != "" {
+		fmt.Fprintf(w, "\n%s\n", c.Long)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	if len(c.Sub) != 0 {
+		fmt.Fprintf(tw, "\ncommands:\n")
+		for _, v := range c.Sub {
+			fmt.Fprintf(tw, "  %s\t%s\n", v.Name, v.Short)
+		}
+	}
+
+	if c.Flags != nil {
+		fs := flag.NewFlagSet(c.Name, flag.ContinueOnError)
+		c.Flags(fs)
+
+		fmt.Fprintf(tw, "\noptions:\n")
+		printFlags(tw, fs)
+	}
+
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	globalFlags(fs)
+
+	fmt.Fprintf(tw, "\nglobal options:\n")
+	printFlags(tw, fs)
+
+	tw.Flush()
+
+	if len(c.Sub) != 0 {
+		top := c
+		for top.parent != nil {
+			top = top.parent
+		}
+
+		fmt.Fprintf(w, "\nrun \"%s help <command>\" for more information on a command.\n", top.Name)
+	}
+}
+
+// printFlags writes a line for each flag in fs, with short names alongside
+// the long ones.
+func printFlags(w io.Writer, fs *flag.FlagSet) {
+	fs.VisitAll(func(f *flag.Flag) {
+		if _, ok := longFlags[f.Name]; ok {
+			// Printed along with the long name.
+			return
+		}
+
+		name, usage := flag.UnquoteUsage(f)
+
+		names := "--" + f.Name
+		if s := shortFlags[f.Name]; s != "" {
+			names = "-" + s + ", " + names
+		}
+		if name != "" {
+			names += " " + name
+		}
+
+		if f.DefValue != "" && f.DefValue != "false" && f.DefValue != "0" {
+			usage += fmt.Sprintf(" (default %s)", f.DefValue)
+		}
+
+		fmt.Fprintf(w, "  %s\t%s\n", names, usage)
+	})
+}
+
+// usageError exits after complaining about how c was used.
+func usageError(c *command, f string, d ...any) {
+	fmt.Fprintf(os.Stderr, "%s: %s\nusage: %s\n", c.path(), fmt.Sprintf(f, d...), c.synopsis())
+	os.Exit(exitUsage)
+}
+
+// execute parses args for c, then either runs it or descends into the
+// subcommand named by the first positional argument.
+//
+// Flags may appear anywhere, unless they come after "--".
+func execute(c *command, args []string) {
+	fs := c.flagSet()
+	pos := []string{}
+
+	for {
+		if err := fs.Parse(args); err != nil {
+			usageError(c, "%v", err)
+		}
+
+		rest := fs.Args()
+		if i := len(args) - len(rest); i > 0 && args[i-1] == "--" {
+			pos = append(pos, rest...)
+			break
+		} else if len(rest) == 0 {
+			break
+		}
+
+		if len(c.Sub) != 0 {
+			sub := c.find(rest[0])
+			if sub == nil {
+				usageError(c, "unknown command %q", rest[0])
+			}
+
+			execute(sub, rest[1:])
+			return
+		}
+
+		pos = append(pos, rest[0])
+		args = rest[1:]
+	}
+
+	if showHelp {
+		c.help(os.Stdout)
+		os.Exit(0)
+	}
+
+	if c.Run == nil {
+		usageError(c, "a command is required")
+	} else if len(pos) < c.MinArgs {
+		usageError(c, "not enough arguments")
+	} else if c.MaxArgs >= 0 && len(pos) > c.MaxArgs {
+		usageError(c, "too many arguments")
+	}
+
+	if !c.NoConfig {
+		setup()
+	}
+
+	c.Run(pos)
+}
+
+// lookup finds the command named by a path of names, e.g. ["new", "device"].
+func (c *command) lookup(path []string) (*command, error) {
+	for _, v := range path {
+		sub := c.find(v)
+		if sub == nil {
+			return nil, fmt.Errorf("unknown command %q", strings.TrimSpace(c.path()+" "+v))
+		}
+		c = sub
+	}
+	return c, nil
+}
+
+// walk calls f for c and all of its subcommands.
+func (c *command) walk(f func(c *command)) {
+	f(c)
+	for _, v := range c.Sub {
+		v.walk(f)
+	}
+}
+
+// flagNames returns the names of all flags that c accepts, prefixed with
+// dashes.
+func (c *command) flagNames() []string {
+	names := []string{}
+	c.flagSet().VisitAll(func(f *flag.Flag) {
+		if len(f.Name) == 1 {
+			names = append(names, "-"+f.Name)
+		} else {
+			names = append(names, "--"+f.Name)
+		}
+	})
+
+	sort.Strings(names)
+	return names
+}
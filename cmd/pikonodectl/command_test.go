@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"testing"
+)
+
+func TestExecute(t *testing.T) {
+	defer func() { output = outputTable }()
+
+	var got []string
+	var join int64
+
+	tree := (&command{
+		Name: "pikonodectl",
+		Sub: []*command{
+			{
+				Name: "list", Aliases: []string{"ls"},
+				Sub: []*command{
+					{Name: "devices", MaxArgs: 0, NoConfig: true, Run: func(args []string) { got = args }},
+				},
+			},
+			{
+				Name: "new",
+				Sub: []*command{
+					{
+						Name: "network", MinArgs: 1, MaxArgs: 1, NoConfig: true,
+						Flags: func(fs *flag.FlagSet) { fs.Int64Var(&join, "join", 0, "") },
+						Run:   func(args []string) { got = args },
+					},
+				},
+			},
+		},
+	}).link()
+
+	tests := []struct {
+		args   []string
+		rest   []string
+		output outputFormat
+		join   int64
+	}{
+		{[]string{"list", "devices"}, []string{}, outputTable, 0},
+		{[]string{"-o", "json", "ls", "devices"}, []string{}, outputJSON, 0},
+		{[]string{"list", "devices", "--output=yaml"}, []string{}, outputYAML, 0},
+		{[]string{"new", "network", "--", "-o"}, []string{"-o"}, outputTable, 0},
+		{[]string{"new", "network", "home", "--join", "3"}, []string{"home"}, outputTable, 3},
+	}
+
+	for _, v := range tests {
+		output, join, got = outputTable, 0, nil
+
+		execute(tree, v.args)
+		if strings.Join(got, " ") != strings.Join(v.rest, " ") || output != v.output || join != v.join {
+			t.Errorf("%q: got %q, %s and %d, expected %q, %s and %d", v.args, got, output, join, v.rest, v.output, v.join)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+func completion(args []string) {
+	switch args[0] {
+	case "bash":
+		completeBash(os.Stdout)
+	case "zsh":
+		fmt.Println("autoload -U +X bashcompinit && bashcompinit")
+		completeBash(os.Stdout)
+	case "fish":
+		completeFish(os.Stdout)
+	default:
+		usageError(root.find("completion"), "unsupported shell %q", args[0])
+	}
+}
+
+// names returns the name and aliases of c.
+func (c *command) names() []string {
+	return append([]string{c.Name}, c.Aliases...)
+}
+
+// paths returns every way c may be spelled after the root command, e.g.
+// "list devices" and "ls devs".
+func (c *command) paths() []string {
+	if c.parent == nil {
+		return []string{""}
+	}
+
+	paths := []string{}
+	for _, p := range c.parent.paths() {
+		for _, n := range c.names() {
+			paths = append(paths, strings.TrimSpace(p+" "+n))
+		}
+	}
+	return paths
+}
+
+// valueFlags returns the names of every flag in the tree that takes a value,
+// prefixed with dashes.
+func valueFlags() []string {
+	seen := map[string]bool{}
+	root.walk(func(c *command) {
+		c.flagSet().VisitAll(func(f *flag.Flag) {
+			if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+				return
+			}
+
+			seen["-"+f.Name] = true
+			if len(f.Name) > 1 {
+				seen["--"+f.Name] = true
+			}
+		})
+	})
+
+	names := make([]string, 0, len(seen))
+	for k := range seen {
+		names = append(names, k)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// completeBash writes a bash completion script.
+func completeBash(w io.Writer) {
+	fmt.Fprintf(w, `_%[1]s() {
+	local cur="${COMP_WORDS[COMP_CWORD]}" prev="${COMP_WORDS[COMP_CWORD-1]}"
+	local path="" cmds="" flags="" i
+
+	case "$prev" in
+	-o|-output|--output)
+		COMPREPLY=($(compgen -W "table json yaml" -- "$cur"))
+		return ;;
+	-c|-config|--config)
+		COMPREPLY=($(compgen -f -- "$cur"))
+		return ;;
+	-p|-profile|--profile)
+		COMPREPLY=($(compgen -W "$(%[1]s profiles -o json 2>/dev/null | sed -n 's/^ *"name": "\(.*\)",$/\1/p')" -- "$cur"))
+		return ;;
+	esac
+
+	for ((i = 1; i < COMP_CWORD; i++)); do
+		case "${COMP_WORDS[i]}" in
+		%[2]s) ((i++)) ;;
+		-*) ;;
+		*) path="$path ${COMP_WORDS[i]}" ;;
+		esac
+	done
+
+	case "${path# }" in
+`, root.Name, strings.Join(valueFlags(), "|"))
+
+	root.walk(func(c *command) {
+		cmds := append([]string{}, c.Choices...)
+		for _, v := range c.Sub {
+			cmds = append(cmds, v.Name)
+		}
+
+		pats := []string{}
+		for _, p := range c.paths() {
+			pats = append(pats, fmt.Sprintf("%q", p))
+		}
+
+		fmt.Fprintf(w, "\t%s)\n\t\tcmds=%q\n\t\tflags=%q ;;\n",
+			strings.Join(pats, "|"), strings.Join(cmds, " "), strings.Join(c.flagNames(), " "))
+	})
+
+	fmt.Fprintf(w, `	*) return ;;
+	esac
+
+	if [[ "$cur" == -* ]]; then
+		COMPREPLY=($(compgen -W "$flags" -- "$cur"))
+	else
+		COMPREPLY=($(compgen -W "$cmds" -- "$cur"))
+	fi
+}
+
+complete -F _%[1]s %[1]s
+`, root.Name)
+}
+
+// fishQuote quotes s for fish.
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
+
+// fishCondition returns a fish condition that is true when c has been typed.
+func (c *command) fishCondition() string {
+	if c.parent == nil {
+		return "__fish_use_subcommand"
+	}
+
+	conds := []string{}
+	for p := c; p.parent != nil; p = p.parent {
+		conds = append([]string{"__fish_seen_subcommand_from " + strings.Join(p.names(), " ")}, conds...)
+	}
+	return strings.Join(conds, "; and ")
+}
+
+// completeFish writes a fish completion script.
+func completeFish(w io.Writer) {
+	name := root.Name
+	fmt.Fprintf(w, "complete -c %s -f\n", name)
+
+	// Global flags
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	globalFlags(fs)
+	usage := func(name string) string {
+		_, usage := flag.UnquoteUsage(fs.Lookup(name))
+		return fishQuote(usage)
+	}
+
+	fmt.Fprintf(w, "complete -c %s -s o -l output -x -a 'table json yaml' -d %s\n", name, usage("output"))
+	fmt.Fprintf(w, "complete -c %s -s c -l config -r -F -d %s\n", name, usage("config"))
+	fmt.Fprintf(w, `complete -c %s -s p -l profile -x -a '(%s profiles -o json 2>/dev/null | string replace -rf "^ *\"name\": \"(.*)\",\$" "\$1")' -d %s`+"\n", name, name, usage("profile"))
+	fmt.Fprintf(w, "complete -c %s -s h -l help -d %s\n", name, usage("help"))
+
+	root.walk(func(c *command) {
+		cond := fishQuote(c.fishCondition())
+
+		for _, v := range c.Sub {
+			fmt.Fprintf(w, "complete -c %s -n %s -a %s -d %s\n", name, cond, v.Name, fishQuote(v.Short))
+		}
+
+		if len(c.Choices) != 0 {
+			fmt.Fprintf(w, "complete -c %s -n %s -a %s\n", name, cond, fishQuote(strings.Join(c.Choices, " ")))
+		}
+
+		if c.Flags != nil {
+			fs := flag.NewFlagSet("", flag.ContinueOnError)
+			c.Flags(fs)
+			fs.VisitAll(func(f *flag.Flag) {
+				if _, ok := longFlags[f.Name]; ok {
+					return
+				}
+
+				_, usage := flag.UnquoteUsage(f)
+				fmt.Fprintf(w, "complete -c %s -n %s -l %s -d %s\n", name, cond, f.Name, fishQuote(usage))
+			})
+		}
+	})
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mca3/pikonode/internal/control"
+)
+
+// daemonTimeout is how long to wait for pikonoded to answer.
+var daemonTimeout = 10 * time.Second
+
+// daemonInstance is the instance that requests are made for, or the first one
+// if empty.
+var daemonInstance = ""
+
+func timeoutFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&daemonTimeout, "timeout", daemonTimeout, "how long to wait for pikonoded to answer")
+}
+
+func daemonFlags(fs *flag.FlagSet) {
+	timeoutFlags(fs)
+	fs.StringVar(&daemonInstance, "instance", daemonInstance, "`name` of the instance to show, if pikonoded runs several")
+}
+
+// dialDaemon connects to the first running pikonoded that answers on its
+// control socket.
+func dialDaemon(ctx context.Context) *control.Client {
+	dir, err := control.RuntimeDir()
+	if err != nil {
+		die("failed to find runtime directory: %v", err)
+	}
+
+	socks, err := control.FindSockets(dir)
+	if err != nil {
+		die("failed to look for pikonoded: %v", err)
+	}
+
+	for _, v := range socks {
+		c, err := control.Dial(ctx, v)
+		if err == nil {
+			return c
+		}
+	}
+
+	die("pikonoded does not appear to be running (looked in %s)", dir)
+	return nil
+}
+
+// ago formats the time since t in a human friendly way.
+func ago(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+
+	return time.Since(t).Round(time.Second).String() + " ago"
+}
+
+// formatBytes formats a byte count in a human friendly way.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func status(args []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), daemonTimeout)
+	defer cancel()
+
+	c := dialDaemon(ctx)
+	defer c.Close()
+
+	st := control.Status{}
+	if err := c.Call(ctx, control.MethodStatus, control.InstanceParams{Instance: daemonInstance}, &st); err != nil {
+		die("failed to fetch status: %v", err)
+	}
+
+	printResult(st, func() {
+		fmt.Printf("pikonoded pid %d, up %s\n", st.PID, time.Since(st.Started).Round(time.Second))
+		fmt.Printf("instance %s\n", st.Instance)
+		fmt.Printf("device id %d name \"%s\" ip %s\n", st.Device.ID, st.Device.Name, st.Device.IP)
+		fmt.Printf("interface %s, listen port %d\n", st.Interface, st.ListenPort)
+		if st.Connected {
+			fmt.Printf("rendezvous %s (connected)\n", st.Rendezvous)
+		} else {
+			fmt.Printf("rendezvous %s (disconnected)\n", st.Rendezvous)
+		}
+		fmt.Printf("%d networks, %d peers\n", st.Networks, st.Peers)
+	})
+}
+
+func peers(args []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), daemonTimeout)
+	defer cancel()
+
+	c := dialDaemon(ctx)
+	defer c.Close()
+
+	ps := []control.Peer{}
+	if err := c.Call(ctx, control.MethodPeers, control.InstanceParams{Instance: daemonInstance}, &ps); err != nil {
+		die("failed to fetch peers: %v", err)
+	}
+
+	printResult(ps, func() {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tIP\tENDPOINT\tSOURCE\tHANDSHAKE\tRX\tTX")
+		for _, v := range ps {
+			ep := v.Endpoint
+			if ep == "" {
+				ep = "-"
+			}
+
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				v.Name, v.IP, ep, v.Source, ago(v.LastHandshake),
+				formatBytes(v.RxBytes), formatBytes(v.TxBytes))
+		}
+		w.Flush()
+	})
+}
+
+func showInstances(args []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), daemonTimeout)
+	defer cancel()
+
+	c := dialDaemon(ctx)
+	defer c.Close()
+
+	sts := []control.Status{}
+	if err := c.Call(ctx, control.MethodInstances, nil, &sts); err != nil {
+		die("failed to fetch instances: %v", err)
+	}
+
+	printResult(sts, func() {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tINTERFACE\tPORT\tIP\tRENDEZVOUS\tCONNECTED\tPEERS")
+		for _, v := range sts {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%v\t%d\n",
+				v.Instance, v.Interface, v.ListenPort, v.Device.IP, v.Rendezvous, v.Connected, v.Peers)
+		}
+		w.Flush()
+	})
+}
+
+// reload asks pikonoded to re-read its config files.
+func reload(args []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), daemonTimeout)
+	defer cancel()
+
+	c := dialDaemon(ctx)
+	defer c.Close()
+
+	res := control.ReloadResult{}
+	if err := c.Call(ctx, control.MethodReload, nil, &res); err != nil {
+		die("failed to reload: %v", err)
+	}
+
+	printResult(res, func() {
+		if len(res.Applied) == 0 && len(res.Restart) == 0 {
+			fmt.Println("nothing changed")
+		}
+		for _, v := range res.Applied {
+			fmt.Printf("applied %s\n", v)
+		}
+		for _, v := range res.Restart {
+			fmt.Printf("restart pikonoded to apply %s\n", v)
+		}
+	})
+}
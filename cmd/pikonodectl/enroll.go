@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/mca3/pikonode/internal/config"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// stringList is a flag that may be given more than once, or with several
+// comma separated values.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+// Set implements flag.Value.
+func (l *stringList) Set(v string) error {
+	for _, v := range strings.Split(v, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+var (
+	enrollName  string
+	enrollJoin  stringList
+	enrollForce bool
+)
+
+func enrollFlags(fs *flag.FlagSet) {
+	fs.StringVar(&enrollName, "name", "", "`name` of the device; defaults to the hostname")
+	fs.Var(&enrollJoin, "join", "join the device to a `network`; may be given more than once")
+	fs.BoolVar(&enrollForce, "force", false, "enroll again even if this node already has a device")
+}
+
+// enroll registers this node as a new device, saving its keys to the config
+// file.
+func enroll(args []string) {
+	ctx := context.Background()
+
+	if (config.Cfg.DeviceID != 0 || config.Cfg.PrivateKey != "") && !enrollForce {
+		die("this node is already enrolled as device %d; use --force to enroll it again", config.Cfg.DeviceID)
+	}
+
+	name := enrollName
+	if name == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			die("failed to find hostname, use --name: %v", err)
+		}
+		name = hostname
+	}
+
+	// Resolve networks first so that nothing is made if one is wrong.
+	nws := make([]int64, 0, len(enrollJoin))
+	for _, v := range enrollJoin {
+		nws = append(nws, resolveNetwork(v))
+	}
+
+	privKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		die("failed to generate private key: %v", err)
+	}
+
+	pubKey := privKey.PublicKey()
+
+	d, err := rv.NewDevice(ctx, name, pubKey.String())
+	if err != nil {
+		dieAPI("couldn't add device", err)
+	}
+
+	if old := config.Cfg.DeviceID; old != 0 && old != d.ID {
+		fmt.Fprintf(os.Stderr, "device %d is still registered; remove it with \"%s rm device %d\"\n", old, root.Name, old)
+	}
+
+	config.Cfg.DeviceID = d.ID
+	config.Cfg.PrivateKey = privKey.String()
+	config.Cfg.PublicKey = pubKey.String()
+	if err := config.SaveConfigFile(); err != nil {
+		die("failed to save config: %v\nthe device id is %d and the private key is %s", err, d.ID, privKey)
+	}
+
+	for _, v := range nws {
+		if err := rv.JoinNetwork(ctx, d.ID, v); err != nil {
+			dieAPI(fmt.Sprintf("enrolled as device %d, but couldn't join network %d", d.ID, v), err)
+		}
+	}
+
+	if len(nws) != 0 {
+		if d, err = rv.Device(ctx, d.ID); err != nil {
+			dieAPI("couldn't fetch device", err)
+		}
+	}
+
+	printResult(d, func() {
+		fmt.Printf("enrolled as device id %d name \"%s\" ip %s\n", d.ID, d.Name, d.IP)
+		for _, v := range d.Networks {
+			fmt.Printf("- network id %d name \"%s\"\n", v.ID, v.Name)
+		}
+	})
+}
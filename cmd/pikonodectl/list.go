@@ -4,55 +4,53 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"strings"
+	"text/tabwriter"
 )
 
-func listNetworks() {
+func listNetworks(args []string) {
 	nws, err := rv.Networks(context.Background())
 	if err != nil {
-		die("failed to list networks: %v", err)
+		dieAPI("failed to list networks", err)
 	}
 
-	for i, v := range nws {
-		fmt.Printf("network id %d name \"%s\"\n", v.ID, v.Name)
-		for _, v := range v.Devices {
-			fmt.Printf("- device id %d name \"%s\" (%s)\n", v.ID, v.Name, v.Endpoint)
-		}
+	printResult(nws, func() {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tDEVICES")
+		for _, v := range nws {
+			names := make([]string, 0, len(v.Devices))
+			for _, v := range v.Devices {
+				names = append(names, v.Name)
+			}
 
-		if i != len(nws)-1 {
-			fmt.Println()
+			fmt.Fprintf(w, "%d\t%s\t%s\n", v.ID, v.Name, strings.Join(names, ", "))
 		}
-	}
+		w.Flush()
+	})
 }
 
-func listDevices() {
+func listDevices(args []string) {
 	devs, err := rv.Devices(context.Background())
 	if err != nil {
-		die("failed to list devices: %v", err)
+		dieAPI("failed to list devices", err)
 	}
 
-	for i, v := range devs {
-		fmt.Printf("device id %d name \"%s\" (%s)\n", v.ID, v.Name, v.Endpoint)
-		for _, v := range v.Networks {
-			fmt.Printf("- network id %d name \"%s\"\n", v.ID, v.Name)
+	printResult(devs, func() {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tIP\tENDPOINT\tNETWORKS")
+		for _, v := range devs {
+			ep := v.Endpoint
+			if ep == "" {
+				ep = "-"
+			}
+
+			names := make([]string, 0, len(v.Networks))
+			for _, v := range v.Networks {
+				names = append(names, v.Name)
+			}
+
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", v.ID, v.Name, v.IP, ep, strings.Join(names, ", "))
 		}
-
-		if i != len(devs)-1 {
-			fmt.Println()
-		}
-	}
-}
-
-func list(args []string) {
-	if len(args) == 0 {
-		die("usage: %s list {networks,devices}", os.Args[0])
-	}
-
-	switch args[0] {
-	case "networks", "network", "nets", "net", "nws", "nw":
-		listNetworks()
-	case "devices", "device", "devs", "dev", "ds", "d":
-		listDevices()
-	default:
-		die("can only list devices and networks")
-	}
+		w.Flush()
+	})
 }
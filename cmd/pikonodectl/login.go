@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/mca3/pikonode/api"
+	"github.com/mca3/pikonode/internal/config"
+)
+
+var (
+	loginPasswordStdin bool
+	loginShowToken     bool
+)
+
+func loginFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&loginPasswordStdin, "password-stdin", false, "read the password from standard input")
+	fs.BoolVar(&loginShowToken, "show-token", false, "print the token once logged in")
+}
+
+// readLine reads a single line from r, without the line ending.
+func readLine(r io.Reader) (string, error) {
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && !(errors.Is(err, io.EOF) && line != "") {
+		return "", err
+	}
+
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// prompt asks for a line of input on the terminal.
+func prompt(what string) string {
+	fmt.Fprint(os.Stderr, what)
+
+	line, err := readLine(os.Stdin)
+	if err != nil {
+		die("failed to read %s: %v", strings.TrimSuffix(what, ": "), err)
+	}
+	return line
+}
+
+// promptPassword asks for a password on the terminal without echoing it.
+func promptPassword(what string) string {
+	restore, err := disableEcho(os.Stdin)
+	if err != nil {
+		die("failed to disable echo: %v", err)
+	}
+
+	// Don't leave the terminal without echo if we're interrupted.
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	defer signal.Stop(sig)
+
+	go func() {
+		if _, ok := <-sig; ok {
+			restore()
+			fmt.Fprintln(os.Stderr)
+			os.Exit(exitFailure)
+		}
+	}()
+
+	fmt.Fprint(os.Stderr, what)
+	line, err := readLine(os.Stdin)
+
+	restore()
+	fmt.Fprintln(os.Stderr)
+
+	if err != nil {
+		die("failed to read password: %v", err)
+	}
+	return line
+}
+
+func login(args []string) {
+	username := config.Cfg.Username
+	if len(args) > 0 {
+		username = args[0]
+	}
+
+	tty := isTerminal(os.Stdin) && !loginPasswordStdin
+	if username == "" && tty {
+		username = prompt("username: ")
+	}
+	if username == "" {
+		die("a username is required")
+	}
+
+	password := ""
+	switch {
+	case loginPasswordStdin:
+		pw, err := readLine(os.Stdin)
+		if err != nil {
+			die("failed to read password: %v", err)
+		}
+		password = pw
+	case config.LoginPassword() != "":
+		password = config.LoginPassword()
+	case tty:
+		password = promptPassword("password: ")
+	default:
+		die("no password given; use --password-stdin or set $%s", config.PasswordEnv)
+	}
+
+	// Saved along with the token.
+	config.Cfg.Username = username
+
+	if err := rv.Login(context.Background(), username, password); errors.Is(err, api.ErrUnauthorized) {
+		die("failed to login: invalid username or password")
+	} else if err != nil {
+		dieAPI("failed to login", err)
+	}
+
+	res := struct {
+		Username string `json:"username"`
+		Token    string `json:"token,omitempty"`
+	}{Username: username}
+	if loginShowToken {
+		res.Token = rv.CurrentToken()
+	}
+
+	printResult(res, func() {
+		fmt.Printf("logged in as %s\n", res.Username)
+		if res.Token != "" {
+			fmt.Printf("token: %v\n", res.Token)
+		}
+	})
+}
+
+func logout(args []string) {
+	config.Cfg.Token = ""
+	config.Cfg.Password = ""
+	if err := config.SaveConfigFile(); err != nil {
+		die("failed to save config: %v", err)
+	}
+
+	printResult(struct {
+		LoggedIn bool `json:"logged_in"`
+	}{}, nil)
+}
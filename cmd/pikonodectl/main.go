@@ -1,11 +1,10 @@
 package main
 
 import (
-	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
-	"strings"
 
 	"github.com/mca3/pikonode/api"
 	"github.com/mca3/pikonode/internal/config"
@@ -15,71 +14,200 @@ var rv *api.API
 
 func die(f string, d ...any) {
 	fmt.Fprintf(os.Stderr, f+"\n", d...)
-	os.Exit(1)
+	os.Exit(exitFailure)
 }
 
-func login(args []string) {
-	if len(args) < 2 {
-		die("usage: %s login <username> <password>", os.Args[0])
+// dieAPI exits with a message explaining why a request to the Rendezvous
+// server failed, and what can be done about it.
+func dieAPI(what string, err error) {
+	hint := ""
+	switch {
+	case errors.Is(err, api.ErrUnauthorized):
+		hint = fmt.Sprintf("your token was rejected; log in again with \"%s login\"", os.Args[0])
+	case errors.Is(err, api.ErrForbidden):
+		hint = "you do not have permission to do that"
+	case errors.Is(err, api.ErrNotFound):
+		hint = "check that the device or network exists"
+	case errors.Is(err, api.ErrConflict):
+		hint = "it already exists"
+	case errors.Is(err, api.ErrRateLimited):
+		hint = "too many requests; try again later"
 	}
 
-	if err := rv.Login(context.Background(), args[0], args[1]); err != nil {
-		die("failed to login: %v", err)
+	aerr := &api.Error{}
+	if errors.As(err, &aerr) && aerr.Message != "" {
+		err = errors.New(aerr.Message)
 	}
 
-	fmt.Printf("token: %v\n", rv.Token)
+	if aerr.RetryAfter > 0 {
+		hint = fmt.Sprintf("too many requests; try again in %v", aerr.RetryAfter)
+	}
 
-	config.Cfg.Token = rv.Token
-	if err := config.SaveConfigFile(); err != nil {
-		die("failed to save config: %v", err)
+	if hint == "" {
+		die("%s: %v", what, err)
 	}
+	die("%s: %v\n%s", what, err, hint)
 }
 
-func main() {
+// saveToken saves a new token to the config file.
+func saveToken(token string) {
+	if err := config.SaveToken(token); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to save config: %v\n", err)
+	}
+}
+
+// setup reads the config file and prepares the Rendezvous client.
+func setup() {
 	if err := config.ReadConfigFile(); err != nil {
 		die("failed to read config file: %v", err)
 	}
 
-	if len(os.Args) < 2 {
-		fmt.Print(strings.ReplaceAll(`pikonode
-
-%s login <username> <password>
-	login to the rendezvous server
+	var creds api.Credentials
+	if user, pw, ok := config.Cfg.Login(); ok {
+		creds = api.PasswordCredentials{Username: user, Password: pw}
+	}
 
-%s list {networks,devices}
-	list networks or devices attached to your account
+	rv = &api.API{
+		Server:      config.Cfg.Rendezvous,
+		Token:       config.Cfg.Token,
+		Credentials: creds,
+		OnToken:     saveToken,
+		HTTP:        http.DefaultClient,
+	}
+}
 
-%s new device <name> <pubkey>
-	create a new device
+// root is the command tree.
+var root *command
+
+func init() {
+	root = (&command{
+		Name:  "pikonodectl",
+		Short: "pikonodectl manages Pikonet devices and networks, and the running pikonoded.",
+		Long: `Devices and networks may be given by their ID, their name, or the start of
+their name if no other device or network shares it.
+
+Each profile has its own config file, allowing for several Rendezvous servers
+to be used. The profile may also be chosen with $` + config.ProfileEnv + `.`,
+		Sub: []*command{
+			{
+				Name: "login", Args: "[username]", MaxArgs: 1,
+				Short: "login to the rendezvous server",
+				Long: `The password is prompted for, read from standard input with --password-stdin,
+or taken from $` + config.PasswordEnv + `.`,
+				Flags: loginFlags,
+				Run:   login,
+			},
+			{
+				Name: "logout", Short: "forget the token saved by login",
+				Run: logout,
+			},
+			{
+				Name: "list", Aliases: []string{"ls"},
+				Short: "list networks or devices attached to your account",
+				Sub: []*command{
+					{
+						Name: "networks", Aliases: []string{"network", "nets", "net", "nws", "nw"},
+						Short: "list networks",
+						Run:   listNetworks,
+					},
+					{
+						Name: "devices", Aliases: []string{"device", "devs", "dev", "ds", "d"},
+						Short: "list devices",
+						Run:   listDevices,
+					},
+				},
+			},
+			{
+				Name:  "new",
+				Short: "create a new device or network",
+				Sub: []*command{
+					{
+						Name: "device", Aliases: []string{"dev", "d"},
+						Args: "<name> <public key>", MinArgs: 2, MaxArgs: 2,
+						Short: "create a new device",
+						Flags: newDeviceFlags,
+						Run:   newDevice,
+					},
+					{
+						Name: "network", Aliases: []string{"net", "nw"},
+						Args: "<name>", MinArgs: 1, MaxArgs: 1,
+						Short: "create a new network",
+						Run:   newNetwork,
+					},
+				},
+			},
+			{
+				Name: "enroll", MaxArgs: 0,
+				Short: "register this node as a new device, generating its keys",
+				Flags: enrollFlags,
+				Run:   enroll,
+			},
+			{
+				Name: "join", Args: "<device> <network>", MinArgs: 2, MaxArgs: 2,
+				Short: "add a device to a network",
+				Run:   join,
+			},
+			{
+				Name: "leave", Args: "<device> <network>", MinArgs: 2, MaxArgs: 2,
+				Short: "remove a device from a network",
+				Run:   leave,
+			},
+			{
+				Name: "status", Short: "show the status of the running pikonoded",
+				Flags: daemonFlags, NoConfig: true,
+				Run: status,
+			},
+			{
+				Name: "peers", Short: "show the peers of the running pikonoded",
+				Flags: daemonFlags, NoConfig: true,
+				Run: peers,
+			},
+			{
+				Name: "instances", Short: "show every interface that the running pikonoded manages",
+				Flags: daemonFlags, NoConfig: true,
+				Run: showInstances,
+			},
+			{
+				Name: "reload", Short: "make the running pikonoded re-read its config",
+				Long:  "Changes to the Rendezvous server, login, listen port, DNS and local discovery\nare applied without taking the interface down. Anything else needs a restart.",
+				Flags: timeoutFlags, NoConfig: true,
+				Run: reload,
+			},
+			{
+				Name: "profiles", Short: "list the profiles that have config files",
+				NoConfig: true,
+				Run:      profiles,
+			},
+			{
+				Name: "completion", Args: "{bash,zsh,fish}", MinArgs: 1, MaxArgs: 1,
+				Short: "print a shell completion script", NoConfig: true,
+				Choices: []string{"bash", "zsh", "fish"},
+				Run:     completion,
+			},
+			{
+				Name: "help", Args: "[command...]", MaxArgs: -1,
+				Short: "show help for a command", NoConfig: true,
+				Run: help,
+			},
+		},
+	}).link()
+}
 
-%s new network <name>
-	create a new network
+func help(args []string) {
+	c, err := root.lookup(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitUsage)
+	}
 
-%s join <device id> <network id>
-	add a device to a network
+	c.help(os.Stdout)
+}
 
-%s leave <device id> <network id>
-	remove a device from a network
-`, "%s", os.Args[0]))
+func main() {
+	if len(os.Args) < 2 {
+		root.help(os.Stdout)
 		return
 	}
 
-	rv = &api.API{
-		Server: config.Cfg.Rendezvous,
-		Token:  config.Cfg.Token,
-		HTTP:   http.DefaultClient,
-	}
-
-	switch os.Args[1] {
-	case "list", "ls":
-		list(os.Args[2:])
-	case "login":
-		login(os.Args[2:])
-	case "new":
-		cmdNew(os.Args[2:])
-	case "join":
-		join(os.Args[2:])
-	case "leave":
-		leave(os.Args[2:])
-	}
+	execute(root, os.Args[1:])
 }
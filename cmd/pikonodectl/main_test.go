@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mca3/pikonode/api"
+	"github.com/mca3/pikonode/api/apitest"
+	"github.com/mca3/pikonode/internal/config"
+)
+
+// mainEnv makes the test binary run pikonodectl instead of the tests, as
+// commands exit the process when they fail.
+const mainEnv = "PIKONODECTL_TEST_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(mainEnv) == "1" {
+		os.Args = append([]string{"pikonodectl"}, os.Args[1:]...)
+		main()
+		os.Exit(0)
+	}
+
+	os.Exit(m.Run())
+}
+
+// run runs pikonodectl with the config file at path, returning what it
+// printed to standard output.
+func run(t *testing.T, path, stdin string, args ...string) string {
+	t.Helper()
+
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), mainEnv+"=1", config.ConfigEnv+"="+path, config.PasswordEnv+"=")
+	cmd.Stdin = strings.NewReader(stdin)
+
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("pikonodectl %s: %v\n%s", strings.Join(args, " "), err, stderr)
+	}
+	return stdout.String()
+}
+
+// writeConfig writes a config file that uses srv with the token token,
+// returning its path.
+func writeConfig(t *testing.T, srv *apitest.Server, token string) string {
+	t.Helper()
+
+	c := config.Default()
+	c.Rendezvous = srv.URL()
+	c.Token = token
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := config.WriteFile(path, c); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoginAndList(t *testing.T) {
+	srv := apitest.NewServer()
+	defer srv.Close()
+
+	u, _ := srv.AddUser("alice", "hunter2")
+	dev := srv.AddDevice(u.ID, "laptop", "key")
+
+	path := writeConfig(t, srv, "")
+
+	run(t, path, "hunter2\n", "login", "--password-stdin", "alice")
+
+	c, _, err := config.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	} else if c.Username != "alice" || c.Token == "" {
+		t.Fatalf("username = %q, token = %q after login, expected alice and a token", c.Username, c.Token)
+	}
+
+	out := run(t, path, "", "-o", "json", "list", "devices")
+
+	devs := []api.Device{}
+	if err := json.Unmarshal([]byte(out), &devs); err != nil {
+		t.Fatalf("failed to decode %q: %v", out, err)
+	}
+	if len(devs) != 1 || devs[0].ID != dev.ID || devs[0].Name != "laptop" {
+		t.Errorf("list devices = %+v, expected only %+v", devs, dev)
+	}
+}
+
+func TestMembershipResult(t *testing.T) {
+	srv := apitest.NewServer()
+	defer srv.Close()
+
+	u, token := srv.AddUser("alice", "hunter2")
+	dev := srv.AddDevice(u.ID, "laptop", "key")
+	nw := srv.AddNetwork(u.ID, "home")
+
+	path := writeConfig(t, srv, token)
+
+	for _, cmd := range []string{"join", "leave"} {
+		out := run(t, path, "", "-o", "json", cmd, "laptop", "home")
+
+		res := membership{}
+		if err := json.Unmarshal([]byte(out), &res); err != nil {
+			t.Fatalf("failed to decode %q: %v", out, err)
+		}
+
+		want := membership{Device: dev.ID, Network: nw.ID, Member: cmd == "join"}
+		if res != want {
+			t.Errorf("%s = %+v, expected %+v", cmd, res, want)
+		}
+	}
+}
@@ -2,46 +2,29 @@ package main
 
 import (
 	"context"
-	"os"
-	"strconv"
 )
 
-func join(args []string) {
-	if len(args) < 2 {
-		die("usage: %s join <device id> <network id>", os.Args[0])
-	}
-
-	did, err := strconv.Atoi(args[0])
-	if err != nil {
-		die("supply a valid numeric device id")
-	}
+// membership is the result of join and leave.
+type membership struct {
+	Device  int64 `json:"device"`
+	Network int64 `json:"network"`
+	Member  bool  `json:"member"`
+}
 
-	nid, err := strconv.Atoi(args[1])
-	if err != nil {
-		die("supply a valid numeric network id")
+func join(args []string) {
+	res := membership{Device: resolveDevice(args[0]), Network: resolveNetwork(args[1]), Member: true}
+	if err := rv.JoinNetwork(context.Background(), res.Device, res.Network); err != nil {
+		dieAPI("couldn't join network", err)
 	}
 
-	if err := rv.JoinNetwork(context.Background(), int64(did), int64(nid)); err != nil {
-		die("couldn't join network: %v", err)
-	}
+	printResult(res, nil)
 }
 
 func leave(args []string) {
-	if len(args) < 2 {
-		die("usage: %s leave <device id> <network id>", os.Args[0])
-	}
-
-	did, err := strconv.Atoi(args[0])
-	if err != nil {
-		die("supply a valid numeric device id")
+	res := membership{Device: resolveDevice(args[0]), Network: resolveNetwork(args[1])}
+	if err := rv.LeaveNetwork(context.Background(), res.Device, res.Network); err != nil {
+		dieAPI("couldn't leave network", err)
 	}
 
-	nid, err := strconv.Atoi(args[1])
-	if err != nil {
-		die("supply a valid numeric network id")
-	}
-
-	if err := rv.LeaveNetwork(context.Background(), int64(did), int64(nid)); err != nil {
-		die("couldn't leave network: %v", err)
-	}
+	printResult(res, nil)
 }
@@ -2,26 +2,47 @@ package main
 
 import (
 	"context"
-	"os"
+	"flag"
+	"fmt"
 )
 
-func cmdNew(args []string) {
-	// I'm sorry.
-	if len(args) == 0 {
-		die(`usage: %s new device <name> <public key>
-       %s new network <name>`, os.Args[0], os.Args[0])
+// newJoin is a network to join new devices to.
+var newJoin string
+
+func newDeviceFlags(fs *flag.FlagSet) {
+	fs.StringVar(&newJoin, "join", "", "join the new device to a `network`")
+}
+
+func newDevice(args []string) {
+	ctx := context.Background()
+
+	d, err := rv.NewDevice(ctx, args[0], args[1])
+	if err != nil {
+		dieAPI("couldn't add device", err)
 	}
 
-	switch args[0] {
-	case "device", "dev", "d":
-		if _, err := rv.NewDevice(context.Background(), args[1], args[2]); err != nil {
-			die("couldn't add device: %v", err)
+	if newJoin != "" {
+		if err := rv.JoinNetwork(ctx, d.ID, resolveNetwork(newJoin)); err != nil {
+			dieAPI(fmt.Sprintf("added device %d, but couldn't join network", d.ID), err)
 		}
-	case "network", "net", "nw":
-		if _, err := rv.NewNetwork(context.Background(), args[1]); err != nil {
-			die("couldn't add network: %v", err)
+
+		if d, err = rv.Device(ctx, d.ID); err != nil {
+			dieAPI("couldn't fetch device", err)
 		}
-	default:
-		die("can only make new devices and networks")
 	}
+
+	printResult(d, func() {
+		fmt.Printf("device id %d name \"%s\" ip %s\n", d.ID, d.Name, d.IP)
+	})
+}
+
+func newNetwork(args []string) {
+	nw, err := rv.NewNetwork(context.Background(), args[0])
+	if err != nil {
+		dieAPI("couldn't add network", err)
+	}
+
+	printResult(nw, func() {
+		fmt.Printf("network id %d name \"%s\"\n", nw.ID, nw.Name)
+	})
 }
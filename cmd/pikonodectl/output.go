@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// outputFormat is the format that results are printed in.
+type outputFormat string
+
+const (
+	outputTable outputFormat = "table"
+	outputJSON  outputFormat = "json"
+	outputYAML  outputFormat = "yaml"
+)
+
+// output is set with --output.
+var output = outputTable
+
+func (f *outputFormat) String() string { return string(*f) }
+
+// Set implements flag.Value.
+func (f *outputFormat) Set(v string) error {
+	switch o := outputFormat(v); o {
+	case outputTable, outputJSON, outputYAML:
+		*f = o
+		return nil
+	}
+	return fmt.Errorf("unknown output format %q; expected table, json or yaml", v)
+}
+
+// printResult prints the result of a subcommand in the chosen format.
+// table is used to print it for humans, and may be nil if there is nothing
+// to say.
+func printResult(v any, table func()) {
+	var err error
+
+	switch output {
+	case outputJSON:
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(v)
+	case outputYAML:
+		err = writeYAML(os.Stdout, v)
+	default:
+		if table != nil {
+			table()
+		}
+	}
+
+	if err != nil {
+		die("failed to write output: %v", err)
+	}
+}
+
+// writeYAML writes v as a block style YAML document.
+//
+// v is first encoded as JSON so that struct tags are respected, and keys are
+// kept in the order that they were encoded in.
+func writeYAML(w io.Writer, v any) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	// JSON is valid YAML, but it is read back in flow style with quoted
+	// strings, which is not what anyone wants to read.
+	node := &yaml.Node{}
+	if err := yaml.Unmarshal(buf, node); err != nil {
+		return err
+	}
+	blockStyle(node)
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(node); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// blockStyle resets the style of node and its children, so that they are
+// written in block style and strings are only quoted when they have to be.
+//
+// Strings that YAML 1.1 parsers read as booleans stay quoted.
+func blockStyle(node *yaml.Node) {
+	node.Style = 0
+	if node.Kind == yaml.ScalarNode && node.Tag == "!!str" {
+		switch strings.ToLower(node.Value) {
+		case "y", "yes", "n", "no", "on", "off":
+			node.Style = yaml.DoubleQuotedStyle
+		}
+	}
+
+	for _, v := range node.Content {
+		blockStyle(v)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/mca3/pikonode/api"
+	"gopkg.in/yaml.v3"
+)
+
+func TestWriteYAML(t *testing.T) {
+	nws := []api.Network{
+		{ID: 1, Name: "home", Devices: []api.Device{
+			{ID: 2, Name: "laptop", PublicKey: "+AAA=", IP: "fd00::2", Endpoint: "1.2.3.4:5"},
+		}},
+		{ID: 3, Name: "yes", Devices: []api.Device{}},
+	}
+
+	expected := `- id: 1
+  owner: 0
+  name: home
+  devices:
+    - id: 2
+      owner: 0
+      name: laptop
+      key: +AAA=
+      ip: fd00::2
+      endpoint: 1.2.3.4:5
+- id: 3
+  owner: 0
+  name: "yes"
+  devices: []
+`
+
+	sb := &strings.Builder{}
+	if err := writeYAML(sb, nws); err != nil {
+		t.Fatalf("failed to write YAML: %v", err)
+	}
+
+	if sb.String() != expected {
+		t.Errorf("got:\n%s\nexpected:\n%s", sb.String(), expected)
+	}
+
+	// Reading it back must give what was encoded as JSON.
+	var fromYAML, fromJSON any
+	if err := yaml.Unmarshal([]byte(sb.String()), &fromYAML); err != nil {
+		t.Fatalf("failed to read YAML back: %v", err)
+	}
+
+	buf, _ := json.Marshal(nws)
+	json.Unmarshal(buf, &fromJSON)
+
+	got, _ := json.Marshal(fromYAML)
+	want, _ := json.Marshal(fromJSON)
+	if !bytes.Equal(got, want) {
+		t.Errorf("YAML read back as %s, expected %s", got, want)
+	}
+}
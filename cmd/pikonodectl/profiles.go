@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/mca3/pikonode/internal/config"
+)
+
+// profile describes a profile for the profiles command.
+type profile struct {
+	Name       string `json:"name"`
+	Current    bool   `json:"current"`
+	Path       string `json:"path"`
+	Rendezvous string `json:"rendezvous,omitempty"`
+	Username   string `json:"username,omitempty"`
+	DeviceID   int64  `json:"device_id,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+func profiles(args []string) {
+	names, err := config.Profiles()
+	if err != nil {
+		die("failed to list profiles: %v", err)
+	}
+
+	ps := make([]profile, 0, len(names))
+	for _, v := range names {
+		p := profile{Name: v, Current: v == config.CurrentProfile()}
+
+		if p.Path, err = config.ProfilePath(v); err != nil {
+			p.Error = err.Error()
+		} else if c, _, _, err := config.Load(p.Path); err != nil {
+			p.Error = err.Error()
+		} else {
+			p.Rendezvous, p.Username, p.DeviceID = c.Rendezvous, c.Username, c.DeviceID
+		}
+
+		ps = append(ps, p)
+	}
+
+	printResult(ps, func() {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "\tNAME\tRENDEZVOUS\tUSERNAME\tDEVICE")
+		for _, v := range ps {
+			cur := ""
+			if v.Current {
+				cur = "*"
+			}
+
+			if v.Error != "" {
+				fmt.Fprintf(w, "%s\t%s\t(%s)\t\t\n", cur, v.Name, v.Error)
+				continue
+			}
+
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\n", cur, v.Name, v.Rendezvous, v.Username, v.DeviceID)
+		}
+		w.Flush()
+	})
+}
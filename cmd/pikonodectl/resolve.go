@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// candidate is a device or network that an argument may refer to.
+type candidate struct {
+	ID   int64
+	Name string
+}
+
+// match finds the candidate that s refers to, which may be its ID, its name,
+// or a prefix of its name that no other candidate shares.
+//
+// A numeric s that matches no candidate is returned as is, as the Rendezvous
+// server may know of devices and networks that are not in our lists.
+func match(what, s string, cands []candidate) (int64, error) {
+	id, err := strconv.ParseInt(s, 10, 64)
+	isID := err == nil
+
+	if isID {
+		for _, v := range cands {
+			if v.ID == id {
+				return id, nil
+			}
+		}
+	}
+
+	var exact, prefix []candidate
+	for _, v := range cands {
+		if v.Name == s {
+			exact = append(exact, v)
+		} else if strings.HasPrefix(v.Name, s) {
+			prefix = append(prefix, v)
+		}
+	}
+
+	found := exact
+	if len(found) == 0 {
+		found = prefix
+	}
+
+	switch {
+	case len(found) == 1:
+		return found[0].ID, nil
+	case len(found) > 1:
+		sb := &strings.Builder{}
+		fmt.Fprintf(sb, "%q matches more than one %s:", s, what)
+		for _, v := range found {
+			fmt.Fprintf(sb, "\n  %d\t%s", v.ID, v.Name)
+		}
+		return 0, fmt.Errorf("%s\nuse the id or more of the name", sb)
+	case isID:
+		return id, nil
+	}
+
+	return 0, fmt.Errorf("no %s is named %q", what, s)
+}
+
+// resolveDevice finds the ID of a device from its ID, name or a unique prefix
+// of its name.
+func resolveDevice(s string) int64 {
+	devs, err := rv.Devices(context.Background())
+	if err != nil {
+		dieAPI("failed to list devices", err)
+	}
+
+	cands := make([]candidate, 0, len(devs))
+	for _, v := range devs {
+		cands = append(cands, candidate{v.ID, v.Name})
+	}
+
+	id, err := match("device", s, cands)
+	if err != nil {
+		die("%v", err)
+	}
+	return id
+}
+
+// resolveNetwork finds the ID of a network from its ID, name or a unique
+// prefix of its name.
+func resolveNetwork(s string) int64 {
+	nws, err := rv.Networks(context.Background())
+	if err != nil {
+		dieAPI("failed to list networks", err)
+	}
+
+	cands := make([]candidate, 0, len(nws))
+	for _, v := range nws {
+		cands = append(cands, candidate{v.ID, v.Name})
+	}
+
+	id, err := match("network", s, cands)
+	if err != nil {
+		die("%v", err)
+	}
+	return id
+}
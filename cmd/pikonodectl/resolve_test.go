@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	cands := []candidate{
+		{1, "laptop"},
+		{2, "lapdog"},
+		{3, "desktop"},
+		{4, "desk"},
+		{5, "42"},
+	}
+
+	tests := []struct {
+		arg string
+		id  int64
+		err string
+	}{
+		{"1", 1, ""},
+		{"laptop", 1, ""},
+		{"lapt", 1, ""},
+		{"des", 0, "matches more than one"},
+		{"desk", 4, ""},
+		{"lap", 0, "matches more than one"},
+		{"42", 5, ""},
+		{"99", 99, ""},
+		{"phone", 0, "no device"},
+	}
+
+	for _, v := range tests {
+		id, err := match("device", v.arg, cands)
+		if v.err != "" {
+			if err == nil || !strings.Contains(err.Error(), v.err) {
+				t.Errorf("%q: got %d and %v, expected error containing %q", v.arg, id, err, v.err)
+			}
+			continue
+		}
+
+		if err != nil || id != v.id {
+			t.Errorf("%q: got %d and %v, expected %d", v.arg, id, err, v.id)
+		}
+	}
+
+	_, err := match("device", "lap", cands)
+	if !strings.Contains(err.Error(), "laptop") || !strings.Contains(err.Error(), "lapdog") {
+		t.Errorf("ambiguous error %q does not list the candidates", err)
+	}
+}
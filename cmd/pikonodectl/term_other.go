@@ -0,0 +1,21 @@
+//go:build !linux && !windows
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// isTerminal determines if f is a terminal.
+//
+// This is not supported on this platform, so f is never considered to be
+// one.
+func isTerminal(f *os.File) bool {
+	return false
+}
+
+// disableEcho is not supported on this platform.
+func disableEcho(f *os.File) (restore func(), err error) {
+	return nil, errors.New("cannot disable echo on this platform")
+}
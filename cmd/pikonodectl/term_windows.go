@@ -0,0 +1,31 @@
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// isTerminal determines if f is a terminal.
+func isTerminal(f *os.File) bool {
+	var mode uint32
+	return windows.GetConsoleMode(windows.Handle(f.Fd()), &mode) == nil
+}
+
+// disableEcho stops the console f from echoing what is typed into it until
+// restore is called.
+func disableEcho(f *os.File) (restore func(), err error) {
+	h := windows.Handle(f.Fd())
+
+	var old uint32
+	if err := windows.GetConsoleMode(h, &old); err != nil {
+		return nil, err
+	}
+
+	mode := old&^windows.ENABLE_ECHO_INPUT | windows.ENABLE_PROCESSED_INPUT | windows.ENABLE_LINE_INPUT
+	if err := windows.SetConsoleMode(h, mode); err != nil {
+		return nil, err
+	}
+
+	return func() { windows.SetConsoleMode(h, old) }, nil
+}
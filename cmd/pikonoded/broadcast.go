@@ -7,22 +7,24 @@ import (
 	"sync"
 	"time"
 
-	"github.com/mca3/pikonode/internal/config"
 	"github.com/mca3/pikonode/net/discov"
-	"github.com/mca3/pikonode/net/wg"
 )
 
 type discovPeer struct {
 	LastSeen time.Time
 	Endpoint string
+
+	// expiry reconciles our peers once the peer has been quiet for
+	// discovGracePeriod, so that its LAN endpoint is dropped.
+	expiry *time.Timer
 }
 
 const (
 	// Controls the amount of time since a HELLO we will consider a local
 	// peer as alive.
 	//
-	// When time.Now().Add(discovGracePeriod).Before(peer.LastSeen), the
-	// discovPeer is valid.
+	// When time.Since(peer.LastSeen) < discovGracePeriod, the discovPeer is
+	// valid.
 	discovGracePeriod = time.Minute * 2
 )
 
@@ -39,7 +41,7 @@ var seenMut sync.Mutex
 
 // Valid returns true if the peer has sent a HELLO recently.
 func (d discovPeer) Valid() bool {
-	return time.Now().Add(discovGracePeriod).Before(d.LastSeen)
+	return time.Since(d.LastSeen) < discovGracePeriod
 }
 
 // localPeer looks up the specified public key to determine if a peer has sent
@@ -58,6 +60,46 @@ func localPeer(key string) (discovPeer, bool) {
 	return discovPeer{}, false
 }
 
+// seePeer records that the peer with the public key key has sent a HELLO from
+// endpoint, and determines if that changes the LAN endpoint that we use for
+// it.
+func seePeer(key, endpoint string) bool {
+	seenMut.Lock()
+	defer seenMut.Unlock()
+
+	old, ok := seenPeers[key]
+	changed := !ok || !old.Valid() || old.Endpoint != endpoint
+
+	p := discovPeer{LastSeen: time.Now(), Endpoint: endpoint, expiry: old.expiry}
+	if p.expiry == nil {
+		p.expiry = time.AfterFunc(discovGracePeriod, wgUpdateAllPeers)
+	} else {
+		p.expiry.Reset(discovGracePeriod)
+	}
+	seenPeers[key] = p
+
+	return changed
+}
+
+// wgUpdateAllPeers reconciles the peers of every instance.
+func wgUpdateAllPeers() {
+	for _, v := range instances {
+		v.eng.Lock()
+		v.wgUpdatePeers()
+		v.eng.Unlock()
+	}
+}
+
+// discoveryEnabled determines if any instance uses local discovery.
+func discoveryEnabled() bool {
+	for _, v := range instances {
+		if v.config().Discovery {
+			return true
+		}
+	}
+	return false
+}
+
 // listenBroadcast listens for discovery packets on the local interface.
 func listenBroadcast(ctx context.Context) error {
 	ctx, cancel := context.WithCancel(ctx)
@@ -68,18 +110,25 @@ func listenBroadcast(ctx context.Context) error {
 		Ready:  make(chan struct{}),
 	}
 
-	errCh := make(chan error)
+	errCh := make(chan error, 1)
 	go func() {
 		errCh <- discovConn.Listen(ctx)
 	}()
 
 	// Wait to send the first Hello by waiting until we're ready.
-	<-discovConn.Ready
+	select {
+	case <-discovConn.Ready:
+	case err := <-errCh:
+		return err
+	}
+
 	sendDiscovHello(false)
 
 	for {
 		select {
 		case <-ctx.Done():
+			// Wait for the socket to be closed.
+			<-errCh
 			return nil
 		case err := <-errCh:
 			return err
@@ -89,13 +138,28 @@ func listenBroadcast(ctx context.Context) error {
 	}
 }
 
-// sendDiscovHello sends a Hello message to the network.
+// sendDiscovHello sends a Hello message to the network for every instance.
 //
 // If reply is true, a Hello Reply message will be sent.
 func sendDiscovHello(reply bool) {
 	// Don't send another automatic Hello for at least another minute
 	discovHelloTicker.Reset(time.Minute)
-	discovConn.Send(discov.NewHello(uint16(config.Cfg.ListenPort), config.Cfg.PublicKey, reply))
+
+	for _, v := range instances {
+		if c := v.config(); c.Discovery {
+			discovConn.Send(discov.NewHello(uint16(c.ListenPort), c.PublicKey, reply))
+		}
+	}
+}
+
+// ourKey determines if key is the public key of one of our instances.
+func ourKey(key string) bool {
+	for _, v := range instances {
+		if v.config().PublicKey == key {
+			return true
+		}
+	}
+	return false
 }
 
 // onDiscovHello performs actions based on a received Hello message.
@@ -104,7 +168,7 @@ func sendDiscovHello(reply bool) {
 func onDiscovMessage(addr *net.UDPAddr, msg discov.Message) {
 	if msg.Type != discov.Hello && msg.Type != discov.HelloReply {
 		return
-	} else if msg.Key == config.Cfg.PublicKey {
+	} else if ourKey(msg.Key) {
 		// Ignore ourselves
 		return
 	}
@@ -123,40 +187,10 @@ func onDiscovMessage(addr *net.UDPAddr, msg discov.Message) {
 	// the one specified in the message.
 	addr.Port = int(msg.Port)
 
-	// Add them to the cache
-	seenMut.Lock()
-	seenPeers[msg.Key] = discovPeer{LastSeen: time.Now(), Endpoint: addr.String()}
-	seenMut.Unlock()
-
-	// Determine if we want to connect to them
-	// TODO: Determine if an existing connection is good and ignore this?
-	eng.Lock()
-	defer eng.Unlock()
-
-	ok := false
-	for _, v := range eng.Peers() {
-		if v.PublicKey == msg.Key {
-			ok = true
-			break
-		}
-	}
-
-	if !ok {
-		return
+	// Add them to the cache, and reconcile our peers if that gives them a
+	// new endpoint, which will be picked up if they are one of ours.
+	// This bypasses whatever Rendezvous thinks.
+	if seePeer(msg.Key, addr.String()) {
+		wgUpdateAllPeers()
 	}
-
-	// We want to connect to them.
-	// Bypassing whatever Rendezvous thinks.
-	pkey, err := wg.ParseKey(msg.Key)
-	if err != nil {
-		log.Printf("HELLO from %s sent invalid public key!", addr)
-		return
-	}
-
-	// Add the new peer.
-	// Note that often during startup this will get overridden, so this
-	// isn't the only place where peers are set when discovered locally.
-	wgLock.Lock()
-	wgDev.AddPeer(nil, addr, pkey)
-	wgLock.Unlock()
 }
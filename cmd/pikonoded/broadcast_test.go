@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSeePeer(t *testing.T) {
+	key := "peer"
+
+	if !seePeer(key, "10.0.0.5:1000") {
+		t.Errorf("first HELLO did not change the endpoint")
+	}
+	if seePeer(key, "10.0.0.5:1000") {
+		t.Errorf("repeated HELLO changed the endpoint")
+	}
+	if !seePeer(key, "10.0.0.6:1000") {
+		t.Errorf("HELLO from a new address did not change the endpoint")
+	}
+
+	seenMut.Lock()
+	p := seenPeers[key]
+	p.LastSeen = time.Now().Add(-discovGracePeriod * 2)
+	seenPeers[key] = p
+	seenMut.Unlock()
+
+	if !seePeer(key, "10.0.0.6:1000") {
+		t.Errorf("HELLO after the grace period did not change the endpoint")
+	}
+
+	seenMut.Lock()
+	defer seenMut.Unlock()
+
+	if !seenPeers[key].expiry.Stop() {
+		t.Errorf("no reconcile scheduled for the end of the grace period")
+	}
+	delete(seenPeers, key)
+}
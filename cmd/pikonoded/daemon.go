@@ -2,58 +2,57 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"log"
-	"math/rand"
 	"net"
 	"net/netip"
 	"os"
 	"os/signal"
-	"path/filepath"
 	"sync"
 	"time"
 
 	"github.com/mca3/pikonode/api"
 	"github.com/mca3/pikonode/internal/config"
+	"github.com/mca3/pikonode/internal/control"
 	"github.com/mca3/pikonode/net/dns/resolvconf"
 	"github.com/mca3/pikonode/net/wg"
-	"github.com/mca3/pikonode/piko"
 )
 
-// All of the waitGroup tomfoolery is because we have stuff to clean up on exit
-// via defers and when main() exits, the defers on our couple of goroutines do
-// not run.
-// This is likely not an ideal solution.
+// waitGroup tracks the goroutines that stop when the context given to startup
+// is done, so that shutdown can wait for them before taking the interfaces
+// down.
 var waitGroup = sync.WaitGroup{}
 
-var eng *piko.Engine
+// startTime is the time at which the daemon was started.
+var startTime = time.Now()
 
 // getRuntimeDir gets the runtime directory of the current user, or uses the
 // current working directory as a fallback.
 func getRuntimeDir() string {
-	runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
-	if runtimeDir == "" {
+	if os.Getenv("XDG_RUNTIME_DIR") == "" {
 		log.Printf("XDG_RUNTIME_DIR is unset; using cwd")
+	}
 
-		var err error
-		runtimeDir, err = os.Getwd()
-		if err != nil {
-			log.Fatalf("failed to get working directory: %v", err)
-		}
+	runtimeDir, err := control.RuntimeDir()
+	if err != nil {
+		log.Fatalf("failed to get working directory: %v", err)
 	}
 
 	return runtimeDir
 }
 
-func updateAddr(ctx context.Context, pd api.PunchDetails) error {
-	addr, err := fetchEndpoint(ctx, fmt.Sprintf("[%s]:8743", pd.IP))
+func (in *instance) updateAddr(ctx context.Context, pd api.PunchDetails) error {
+	self := in.self()
+
+	addr, err := fetchEndpoint(ctx, self.IP, fmt.Sprintf("[%s]:8743", pd.IP))
 	if err != nil {
 		return fmt.Errorf("failed to contact pikopunch: %v", err)
 	}
 
-	return eng.API().GatewaySend(ctx, api.GatewayMsg{
+	return in.eng.API().GatewaySend(ctx, api.GatewayMsg{
 		Type:     api.Ping,
-		DeviceID: ourDevice.ID,
+		DeviceID: self.ID,
 		Endpoint: addr,
 	})
 }
@@ -75,13 +74,19 @@ func mustParseUDPAddr(ip string) *net.UDPAddr {
 	return net.UDPAddrFromAddrPort(ap)
 }
 
-// startPikopunch starts the pikopunch client.
-func startPikopunch(ctx context.Context) error {
-	wgLock.Lock()
-	defer wgLock.Unlock()
+// startPikopunch starts the pikopunch client, stopping the one that was
+// already running.
+func (in *instance) startPikopunch(ctx context.Context) error {
+	in.wgLock.Lock()
+	defer in.wgLock.Unlock()
+
+	if in.punchCancel != nil {
+		in.punchCancel()
+	}
+	ctx, in.punchCancel = context.WithCancel(ctx)
 
 	// Request and parse pikopunch details.
-	pd, err := eng.API().PunchDetails(ctx)
+	pd, err := in.eng.API().PunchDetails(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to request pikopunch details: %w", err)
 	}
@@ -92,11 +97,21 @@ func startPikopunch(ctx context.Context) error {
 	}
 
 	// Add it as a peer to Wireguard, as we work over Wireguard.
-	if err := wgDev.AddPeer(mustParseIPNet(pd.IP), mustParseUDPAddr(pd.Endpoint), pdkey); err != nil {
+	in.wgPunchPeer = &wgPeer{
+		Key:      pdkey,
+		IP:       mustParseIPNet(pd.IP),
+		Endpoint: mustParseUDPAddr(pd.Endpoint),
+		Source:   control.SourcePikopunch,
+	}
+
+	if err := in.wgAddPeer(*in.wgPunchPeer); err != nil {
 		return fmt.Errorf("failed to add pikopunch peer: %w", err)
 	}
 
+	waitGroup.Add(1)
 	go func() {
+		defer waitGroup.Done()
+
 		// The goal of this goroutine is to occasionally talk to the
 		// server and ask what our endpoint is to them, which we then
 		// report back to the gateway which *may* tell others.
@@ -117,8 +132,8 @@ func startPikopunch(ctx context.Context) error {
 		}
 
 		// Update our address once WireGuard has "settled."
-		if err := updateAddr(ctx, pd); err != nil {
-			log.Printf("failed to fetch endpoint: %v", err)
+		if err := in.updateAddr(ctx, pd); err != nil && ctx.Err() == nil {
+			in.logf("failed to fetch endpoint: %v", err)
 		}
 
 		// Then, do it every 20 seconds.
@@ -129,8 +144,8 @@ func startPikopunch(ctx context.Context) error {
 				tick.Stop()
 				return
 			case <-tick.C:
-				if err := updateAddr(ctx, pd); err != nil {
-					log.Printf("failed to fetch endpoint: %v", err)
+				if err := in.updateAddr(ctx, pd); err != nil && ctx.Err() == nil {
+					in.logf("failed to fetch endpoint: %v", err)
 				}
 			}
 		}
@@ -139,121 +154,118 @@ func startPikopunch(ctx context.Context) error {
 	return nil
 }
 
-func bringupDns() {
+func (in *instance) bringupDns() {
 	cfg, err := resolvconf.FetchCurrentConfig()
 	if err != nil {
-		log.Printf("unable to fetch current DNS configuration: %v")
+		in.logf("unable to fetch current DNS configuration: %v", err)
 		return
 	}
 	cfg.AddNameserver("127.0.0.1")
 
-	if err := resolvconf.SetDNS(wgDev.Interface(), cfg); err != nil {
-		log.Printf("unable to set DNS configuration: %v", err)
+	in.wgLock.Lock()
+	defer in.wgLock.Unlock()
+
+	if err := resolvconf.SetDNS(in.wgDev.Interface(), cfg); err != nil {
+		in.logf("unable to set DNS configuration: %v", err)
 		return
 	}
+	in.dnsSet = true
 }
 
-func takedownDns() {
-	if err := resolvconf.UnsetDNS(wgDev.Interface()); err != nil {
-		log.Printf("unable to unset DNS configuration: %v", err)
+// takedownDns undoes bringupDns.
+//
+// wgLock must be held.
+func (in *instance) takedownDns() {
+	if err := resolvconf.UnsetDNS(in.wgDev.Interface()); err != nil {
+		in.logf("unable to unset DNS configuration: %v", err)
 	}
+	in.dnsSet = false
 }
 
 func startup(ctx context.Context) error {
-	if err := config.ReadConfigFile(); err != nil {
+	var err error
+	if instances, err = loadInstances(); err != nil {
 		return fmt.Errorf("failed to load config file: %w", err)
 	}
 
 	dir := getRuntimeDir()
-	unixSocket = filepath.Join(dir, fmt.Sprintf("pikonet.%d", os.Getpid()))
+	unixSocket = control.SocketPath(dir, os.Getpid())
 
-	if err := bindUnix(ctx); err != nil {
-		return fmt.Errorf("failed to create UNIX socket: %w", err)
-	}
-
-	// Fetch a port if we need to
-	if config.Cfg.ListenPort == 0 {
-		config.Cfg.ListenPort = int(rand.Uint32()|(1<<10)) & 0xFFFF
-	}
+	cleanupStale(dir, instances)
 
-	var err error
-	if eng, err = piko.NewEngine(piko.Config{
-		Rendezvous: config.Cfg.Rendezvous,
-		DeviceID:   config.Cfg.DeviceID,
-		Token:      config.Cfg.Token,
-		ListenPort: config.Cfg.ListenPort,
-	}); err != nil {
-		return fmt.Errorf("failed to start engine: %w", err)
-	}
-
-	if err := startWireguard(); err != nil {
-		return fmt.Errorf("failed to start wireguard: %w", err)
+	for _, v := range instances {
+		if err := v.start(ctx); err != nil {
+			if len(instances) > 1 {
+				err = fmt.Errorf("instance %q: %w", v.Name, err)
+			}
+			return err
+		}
 	}
 
-	go func() {
-		log.Print(listenDNS())
-	}()
-
-	wgLock.Lock()
-	wgDev.SetState(true)
-	wgLock.Unlock()
-
-	eng.OnJoin(wgOnJoin)
-	eng.OnLeave(wgOnLeave)
-	eng.OnUpdate(wgOnUpdate)
-	eng.OnRebuild(wgOnRebuild)
-
-	eng.OnJoin(dnsOnJoin)
-	eng.OnLeave(dnsOnLeave)
-	eng.OnUpdate(dnsOnUpdate)
-	eng.OnRebuild(dnsOnRebuild)
-
-	if err := eng.Connect(); err != nil {
-		return fmt.Errorf("failed to connect to Rendezvous server: %w", err)
+	if err := bindUnix(ctx); err != nil {
+		return fmt.Errorf("failed to create UNIX socket: %w", err)
 	}
 
-	if err := startPikopunch(ctx); err != nil {
-		return err
-	}
+	reloadMut.Lock()
+	defer reloadMut.Unlock()
 
-	bringupDns()
+	dnsService = startService(ctx, "DNS server", listenDNS)
 
 	// Introduce ourselves now that we're all set up
-	go listenBroadcast(ctx)
+	if discoveryEnabled() {
+		discovService = startService(ctx, "local discovery", listenBroadcast)
+	}
 
 	return nil
 }
 
 func main() {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	flag.StringVar(&config.ConfigFileOverride, "config", "", "path of the config file to use")
+	flag.StringVar(&config.Profile, "profile", "", "name of the profile to use; overrides $"+config.ProfileEnv)
+	flag.Parse()
 
 	if os.Getuid() == 0 {
 		log.Printf("Running with root privileges!")
 	}
 
 	sigchan := make(chan os.Signal, 1)
-	signal.Notify(sigchan, os.Interrupt)
+	signal.Notify(sigchan, shutdownSignals...)
+
+	reloadchan := make(chan os.Signal, 1)
+	signal.Notify(reloadchan, reloadSignals...)
+
+	ctx, cancel := context.WithCancel(context.Background())
 
-	if err := startup(ctx); err != nil {
+	err := startup(ctx)
+	if err != nil {
 		log.Printf("Failed to start: %v", err)
-		goto done
+	} else {
+	wait:
+		for {
+			select {
+			case sig := <-reloadchan:
+				log.Printf("Received %v; reloading config.", sig)
+				if _, err := reload(ctx); err != nil {
+					log.Printf("Failed to reload config: %v", err)
+				}
+			case sig := <-sigchan:
+				log.Printf("Received %v; shutting down.", sig)
+				break wait
+			}
+		}
 	}
 
-	// Wait until we receive a SIGINT
-	<-sigchan
+	signal.Ignore(reloadSignals...)
 
-done:
-	log.Printf("Exiting.")
+	// Give up on cleaning up if we're asked to stop again.
+	go func() {
+		log.Printf("Received %v again; exiting now.", <-sigchan)
+		os.Exit(1)
+	}()
 
-	if wgDev != nil {
-		takedownDns()
+	shutdown(cancel)
 
-		wgLock.Lock()
-		wgDev.SetState(false)
-		wgDev.Close()
-		wgLock.Unlock()
+	if err != nil {
+		os.Exit(1)
 	}
-
-	cancel()
 }
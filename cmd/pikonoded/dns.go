@@ -1,48 +1,229 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"net"
+	"net/netip"
+	"strconv"
 	"strings"
-	"sync"
 
 	"github.com/mca3/pikonode/api"
 	"github.com/mca3/pikonode/net/dns"
 )
 
+// pikonetPrefix holds every Pikonet address; see api.Device.
+var pikonetPrefix = netip.MustParsePrefix("fd00::/32")
+
 type dnsRecord struct {
-	IP net.IP
+	IP     net.IP
+	Device api.Device
+}
+
+// name returns the records published for the device.
+//
+// The device is described in TXT records. Its WireGuard endpoint is published
+// separately by srv.
+func (r dnsRecord) name() dns.Name {
+	return dns.Name{
+		IP: []net.IP{r.IP},
+		TXT: []string{
+			fmt.Sprintf("device-id=%d", r.Device.ID),
+			"public-key=" + r.Device.PublicKey,
+		},
+	}
 }
 
-// dnsMap is a mapping between DNS keys and an IP.
-// dnsMap is protected by dnsMut.
-var dnsMap = map[string]dnsRecord{}
-var dnsMut = sync.RWMutex{}
+// srv returns the SRV record published as _wireguard._udp.<domain>, which
+// points at the port of the WireGuard endpoint of the device, or false if
+// its endpoint is not known.
+func (r dnsRecord) srv(domain string) (dns.SRV, bool) {
+	_, port, err := net.SplitHostPort(r.Device.Endpoint)
+	if err != nil {
+		return dns.SRV{}, false
+	}
+
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return dns.SRV{}, false
+	}
+
+	return dns.SRV{Port: uint16(p), Target: domain}, true
+}
 
 // lookupDns looks up a DNS key.
-func lookupDns(key string) (dnsRecord, bool) {
-	dnsMut.RLock()
-	defer dnsMut.RUnlock()
+func (in *instance) lookupDns(key string) (dnsRecord, bool) {
+	in.dnsMut.RLock()
+	defer in.dnsMut.RUnlock()
 
-	v, ok := dnsMap[key]
+	v, ok := in.dnsMap[key]
 	return v, ok
 }
 
-// listenDNS listens for DNS queries.
-func listenDNS() error {
+// hasDnsNetwork determines if name is the name of one of the networks of the
+// instance.
+func (in *instance) hasDnsNetwork(name string) bool {
+	in.dnsMut.RLock()
+	defer in.dnsMut.RUnlock()
+
+	return in.dnsNetworks[name]
+}
+
+// resolveDns finds the records of a name under the DNS suffix of the
+// instance.
+//
+// Devices are named both <device> and <device>.<network>, and their
+// WireGuard endpoints are published under _wireguard._udp.
+func (in *instance) resolveDns(suffix, q []string) (dns.Name, bool) {
+	srv := false
+	switch {
+	case len(q) > 2 && q[0] == "_wireguard" && q[1] == "_udp":
+		q, srv = q[2:], true
+	case len(q) > 1 && q[0] == "_udp":
+		// Exists because of the name below it, but has no records.
+		_, ok := in.lookupDns(strings.Join(q[1:], "."))
+		return dns.Name{}, ok
+	}
+
+	domain := strings.Join(q, ".")
+	rec, ok := in.lookupDns(domain)
+	if !ok {
+		// Networks exist because of the devices in them.
+		return dns.Name{}, !srv && len(q) == 1 && in.hasDnsNetwork(q[0])
+	} else if !srv {
+		return rec.name(), true
+	}
+
+	v, ok := rec.srv(domain + "." + strings.Join(suffix, "."))
+	if !ok {
+		return dns.Name{}, true
+	}
+	return dns.Name{SRV: []dns.SRV{v}}, true
+}
+
+// resolveReverse finds the name of the peer of any instance whose address is
+// under a name in the reverse zone of pikonetPrefix.
+//
+// Each address has a single PTR record: its short name where that is not
+// ambiguous, or else the first of its names within its networks.
+func resolveReverse(suffix, q []string) (dns.Name, bool) {
+	p, ok := dns.ReverseName(append(q[:len(q):len(q)], suffix...))
+	if !ok {
+		return dns.Name{}, false
+	}
+
+	ptr, labels, found := "", 0, false
+	for _, in := range instances {
+		dnsSuffix := in.config().DNSSuffix
+
+		in.dnsMut.RLock()
+		for k, v := range in.dnsMap {
+			addr, ok := netip.AddrFromSlice(v.IP)
+			if !ok || !p.Contains(addr.Unmap()) {
+				continue
+			}
+
+			// Names above those of single addresses exist, but
+			// have no records.
+			found = true
+			if !p.IsSingleIP() {
+				continue
+			}
+
+			n, l := k+"."+dnsSuffix, strings.Count(k, ".")
+			if ptr == "" || l < labels || (l == labels && n < ptr) {
+				ptr, labels = n, l
+			}
+		}
+		in.dnsMut.RUnlock()
+	}
+
+	if ptr == "" {
+		return dns.Name{}, found
+	}
+	return dns.Name{PTR: []string{ptr}}, found
+}
+
+// instanceBySuffix finds the instance that names its peers under suffix.
+func instanceBySuffix(suffix string) *instance {
+	for _, v := range instances {
+		if v.config().DNSSuffix == suffix {
+			return v
+		}
+	}
+	return nil
+}
+
+// listenDNS answers DNS queries for the names of the peers of every instance
+// until ctx is done.
+func listenDNS(ctx context.Context) error {
+	reverse, err := dns.ReverseZone(pikonetPrefix)
+	if err != nil {
+		return err
+	}
+
+	// Reverse lookups outside of Pikonet go to the fallback.
+	suffixes := [][]string{reverse}
+	for _, v := range instances {
+		suffixes = append(suffixes, strings.Split(v.config().DNSSuffix, "."))
+	}
+
 	srv := dns.Server{
-		Fallback: "1.1.1.1:53",
-		Resolve: func(q []string) (net.IP, bool) {
-			if len(q) == 0 {
-				return net.IP(nil), false
+		Fallback:    instances[0].config().DNSFallback,
+		NegativeTTL: uint32(instances[0].config().DNSNegativeTTL),
+		Resolve: func(suffix, q []string) (dns.Name, bool) {
+			if strings.Join(suffix, ".") == strings.Join(reverse, ".") {
+				return resolveReverse(suffix, q)
 			}
 
-			val, ok := lookupDns(q[len(q)-1])
-			return val.IP, ok
+			in := instanceBySuffix(strings.Join(suffix, "."))
+			if in == nil {
+				return dns.Name{}, false
+			}
+			return in.resolveDns(suffix, q)
 		},
-		Suffix: []string{"pn", "local"},
+		Suffixes: suffixes,
+	}
+
+	uc, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53})
+	if err != nil {
+		return err
+	}
+
+	// Answers that do not fit in a datagram are fetched over TCP.
+	l, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53})
+	if err != nil {
+		uc.Close()
+		return err
 	}
 
-	return srv.Listen(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53})
+	waitGroup.Add(1)
+	go func() {
+		defer waitGroup.Done()
+
+		<-ctx.Done()
+		uc.Close()
+		l.Close()
+	}()
+
+	errCh := make(chan error, 2)
+	go func() {
+		errCh <- srv.Serve(uc)
+	}()
+	go func() {
+		errCh <- srv.ServeTCP(l)
+	}()
+
+	// If either stops on its own, take the other down with it.
+	err = <-errCh
+	uc.Close()
+	l.Close()
+	<-errCh
+
+	if ctx.Err() == nil {
+		return err
+	}
+	return nil
 }
 
 // domainify converts name into something which may be included in a domain name.
@@ -59,33 +240,109 @@ func domainify(name string) string {
 	return strings.Map(mapper, strings.ToLower(name))
 }
 
-func dnsOnJoin(nw *api.Network, dev *api.Device) {
-	dnsUpdatePeers()
+func (in *instance) dnsOnJoin(nw *api.Network, dev *api.Device) {
+	in.dnsUpdatePeers()
 }
 
-func dnsOnLeave(nw *api.Network, dev *api.Device) {
-	dnsUpdatePeers()
+func (in *instance) dnsOnLeave(nw *api.Network, dev *api.Device) {
+	in.dnsUpdatePeers()
 }
 
-func dnsOnUpdate(dev *api.Device) {
-	// TODO: Name changes are not yet supported
-	dnsUpdatePeers()
+func (in *instance) dnsOnUpdate(dev *api.Device) {
+	in.dnsUpdatePeers()
 }
 
-func dnsOnRebuild() {
-	dnsUpdatePeers()
+func (in *instance) dnsOnRebuild() {
+	in.dnsUpdatePeers()
 }
 
-func dnsUpdatePeers() {
-	dnsMut.Lock()
-	defer dnsMut.Unlock()
+// dnsNames computes the names of every device in nws, along with self: a
+// short name for each device, and one within each of its networks.
+//
+// Names that belong to more than one device are ambiguous, so they are
+// returned in conflicts instead.
+func dnsNames(self api.Device, nws []api.Network) (names map[string]dnsRecord, networks map[string]bool, conflicts map[string][]api.Device) {
+	owners := map[string][]api.Device{}
+	add := func(name string, d api.Device) {
+		for _, v := range owners[name] {
+			if v.ID == d.ID {
+				return
+			}
+		}
+		owners[name] = append(owners[name], d)
+	}
 
-	peers := eng.Peers()
-	for _, v := range peers {
-		dnsMap[domainify(v.Name)] = dnsRecord{IP: net.ParseIP(v.IP)}
+	if name := domainify(self.Name); name != "" {
+		add(name, self)
 	}
 
-	// Add ourselves
-	// No need to lock because we have exclusive access
-	dnsMap[domainify(eng.Self().Name)] = dnsRecord{IP: net.ParseIP(eng.Self().IP)}
+	networks = map[string]bool{}
+	for _, nw := range nws {
+		nwName := domainify(nw.Name)
+		if nwName == "" {
+			continue
+		}
+		networks[nwName] = true
+
+		for _, d := range nw.Devices {
+			if d.ID == self.ID {
+				// The engine has the latest copy of ourselves.
+				d = self
+			}
+
+			if name := domainify(d.Name); name != "" {
+				add(name, d)
+				add(name+"."+nwName, d)
+			}
+		}
+	}
+
+	names = make(map[string]dnsRecord, len(owners))
+	conflicts = map[string][]api.Device{}
+	for k, v := range owners {
+		if len(v) > 1 {
+			conflicts[k] = v
+			continue
+		}
+		names[k] = dnsRecord{IP: net.ParseIP(v[0].IP), Device: v[0]}
+	}
+
+	return names, networks, conflicts
+}
+
+// dnsUpdatePeers publishes the names of the devices known to the engine.
+//
+// The engine must be locked.
+func (in *instance) dnsUpdatePeers() {
+	in.dnsPublish(*in.eng.Self(), in.eng.Networks())
+}
+
+// dnsPublish publishes the names of self and the devices in nws.
+//
+// The names are rebuilt from scratch and replaced all at once, so that
+// devices that left or were renamed stop resolving right away.
+func (in *instance) dnsPublish(self api.Device, nws []api.Network) {
+	names, networks, conflicts := dnsNames(self, nws)
+
+	in.dnsMut.Lock()
+	defer in.dnsMut.Unlock()
+
+	in.dnsMap = names
+	in.dnsNetworks = networks
+
+	for k, v := range conflicts {
+		// Only complain once.
+		if !in.dnsConflicts[k] {
+			ids := make([]string, 0, len(v))
+			for _, d := range v {
+				ids = append(ids, strconv.FormatInt(d.ID, 10))
+			}
+			in.logf("Not publishing DNS name %s, as it is used by devices %s.", k, strings.Join(ids, ", "))
+		}
+	}
+
+	in.dnsConflicts = map[string]bool{}
+	for k := range conflicts {
+		in.dnsConflicts[k] = true
+	}
 }
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/mca3/pikonode/api"
+	"github.com/mca3/pikonode/internal/config"
+	"github.com/mca3/pikonode/net/dns"
+)
+
+func TestResolveDns(t *testing.T) {
+	in := newInstance("test", nil)
+	in.dnsMap["laptop"] = dnsRecord{
+		IP:     net.ParseIP("fd00::1"),
+		Device: api.Device{ID: 1, Name: "laptop", Endpoint: "192.0.2.1:51820"},
+	}
+	in.dnsMap["phone"] = dnsRecord{
+		IP:     net.ParseIP("fd00::2"),
+		Device: api.Device{ID: 2, Name: "phone"},
+	}
+
+	suffix := []string{"pn", "local"}
+	tests := []struct {
+		query []string
+		ok    bool
+		srv   bool
+	}{
+		{[]string{"laptop"}, true, false},
+		{[]string{"nobody"}, false, false},
+		{[]string{"www", "laptop"}, false, false},
+		{[]string{"_udp", "laptop"}, true, false},
+		{[]string{"_wireguard", "_udp", "laptop"}, true, true},
+		{[]string{"_wireguard", "_udp", "phone"}, true, false},
+	}
+
+	for _, v := range tests {
+		name, ok := in.resolveDns(suffix, v.query)
+		if ok != v.ok {
+			t.Errorf("%v: ok = %v, expected %v", v.query, ok, v.ok)
+		} else if v.srv != (len(name.SRV) == 1) {
+			t.Errorf("%v: SRV = %v", v.query, name.SRV)
+		} else if v.srv && (name.SRV[0].Port != 51820 || name.SRV[0].Target != "laptop.pn.local") {
+			t.Errorf("%v: SRV = %+v", v.query, name.SRV[0])
+		}
+	}
+}
+
+func TestResolveReverse(t *testing.T) {
+	in := newInstance("test", &config.File{Config: config.Default()})
+	in.dnsMap["laptop"] = dnsRecord{IP: net.ParseIP("fd00::1")}
+	in.dnsMap["laptop.home"] = dnsRecord{IP: net.ParseIP("fd00::1")}
+
+	// build is ambiguous, so it has no short name.
+	in.dnsMap["build.work"] = dnsRecord{IP: net.ParseIP("fd00::3")}
+	in.dnsMap["build.ci"] = dnsRecord{IP: net.ParseIP("fd00::3")}
+
+	old := instances
+	instances = []*instance{in}
+	t.Cleanup(func() {
+		instances = old
+	})
+
+	zone, err := dns.ReverseZone(pikonetPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query string
+		ok    bool
+		ptr   string
+	}{
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0", true, "laptop.pn.local"},
+		{"2.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0", false, ""},
+		{"3.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0", true, "build.ci.pn.local"},
+		{"0.0.0.0", true, ""},
+		{"x", false, ""},
+	}
+
+	for _, v := range tests {
+		name, ok := resolveReverse(zone, strings.Split(v.query, "."))
+		if ok != v.ok {
+			t.Errorf("%s: ok = %v, expected %v", v.query, ok, v.ok)
+		} else if got := strings.Join(name.PTR, " "); got != v.ptr {
+			t.Errorf("%s: PTR = %q, expected %q", v.query, got, v.ptr)
+		}
+	}
+}
+
+func TestDnsNames(t *testing.T) {
+	self := api.Device{ID: 1, Name: "Laptop", IP: "fd00::1"}
+	build1 := api.Device{ID: 2, Name: "build", IP: "fd00::2"}
+	build2 := api.Device{ID: 3, Name: "build", IP: "fd00::3"}
+
+	nws := []api.Network{
+		{ID: 1, Name: "Team", Devices: []api.Device{{ID: 1, Name: "old name"}, build1}},
+		{ID: 2, Name: "customer", Devices: []api.Device{self, build2}},
+	}
+
+	names, networks, conflicts := dnsNames(self, nws)
+
+	got := []string{}
+	for k := range names {
+		got = append(got, k)
+	}
+	sort.Strings(got)
+
+	exp := []string{"build.customer", "build.team", "laptop", "laptop.customer", "laptop.team"}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("names = %v, expected %v", got, exp)
+	}
+
+	if names["laptop.team"].Device.Name != "Laptop" {
+		t.Errorf("laptop.team is %+v, expected our own device", names["laptop.team"].Device)
+	}
+
+	if !networks["team"] || !networks["customer"] || len(networks) != 2 {
+		t.Errorf("networks = %v", networks)
+	}
+
+	if len(conflicts) != 1 || len(conflicts["build"]) != 2 {
+		t.Errorf("conflicts = %v, expected only build", conflicts)
+	}
+}
+
+func TestResolveScopedDns(t *testing.T) {
+	in := newInstance("test", nil)
+	in.dnsMap["build.team"] = dnsRecord{
+		IP:     net.ParseIP("fd00::2"),
+		Device: api.Device{ID: 2, Name: "build", Endpoint: "192.0.2.2:51820"},
+	}
+	in.dnsNetworks = map[string]bool{"team": true}
+
+	suffix := []string{"pn", "local"}
+	tests := []struct {
+		query string
+		ok    bool
+	}{
+		{"build.team", true},
+		{"build", false},
+		{"team", true},
+		{"other", false},
+		{"_udp.build.team", true},
+		{"_wireguard._udp.build.team", true},
+		{"_wireguard._udp.team", false},
+	}
+
+	for _, v := range tests {
+		if _, ok := in.resolveDns(suffix, strings.Split(v.query, ".")); ok != v.ok {
+			t.Errorf("%s: ok = %v, expected %v", v.query, ok, v.ok)
+		}
+	}
+
+	name, _ := in.resolveDns(suffix, []string{"_wireguard", "_udp", "build", "team"})
+	if len(name.SRV) != 1 || name.SRV[0].Target != "build.team.pn.local" {
+		t.Errorf("SRV = %+v", name.SRV)
+	}
+}
+
+func TestDnsPublish(t *testing.T) {
+	in := newInstance("test", nil)
+	self := api.Device{ID: 1, Name: "laptop", IP: "fd00::1"}
+	build := api.Device{ID: 2, Name: "build", IP: "fd00::2"}
+	ci := api.Device{ID: 3, Name: "ci", IP: "fd00::3"}
+
+	in.dnsPublish(self, []api.Network{{ID: 1, Name: "team", Devices: []api.Device{self, build, ci}}})
+
+	// ci leaves and build is renamed.
+	build.Name = "builder"
+	in.dnsPublish(self, []api.Network{{ID: 1, Name: "team", Devices: []api.Device{self, build}}})
+
+	suffix := []string{"pn", "local"}
+	tests := []struct {
+		query string
+		ok    bool
+	}{
+		{"laptop", true},
+		{"builder", true},
+		{"builder.team", true},
+		{"build", false},
+		{"build.team", false},
+		{"ci", false},
+		{"ci.team", false},
+	}
+
+	for _, v := range tests {
+		if _, ok := in.resolveDns(suffix, strings.Split(v.query, ".")); ok != v.ok {
+			t.Errorf("%s: ok = %v, expected %v", v.query, ok, v.ok)
+		}
+	}
+
+	// Leaving the network takes its name with it.
+	in.dnsPublish(self, nil)
+	if _, ok := in.resolveDns(suffix, []string{"team"}); ok {
+		t.Errorf("team still resolves after leaving it")
+	}
+}
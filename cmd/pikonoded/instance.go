@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"math/rand"
+	"sync"
+
+	"github.com/mca3/pikonode/api"
+	"github.com/mca3/pikonode/internal/config"
+	"github.com/mca3/pikonode/net/wg"
+	"github.com/mca3/pikonode/piko"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// instance is a single Pikonet interface, brought up from the config file of
+// a profile.
+//
+// Every instance has its own connection to a Rendezvous server, WireGuard
+// interface and DNS suffix.
+// Local discovery, the DNS server and the control socket are shared between
+// all of them.
+type instance struct {
+	// Name is the name of the profile that the instance was loaded from.
+	Name string
+
+	// conf is replaced when the config is reloaded.
+	// conf is protected by confMu; use config to read it.
+	conf   *config.File
+	confMu sync.RWMutex
+
+	eng *piko.Engine
+
+	wgDev  wg.Device
+	wgLock sync.Mutex
+
+	// dnsSet is true once bringupDns has configured DNS for wgDev.
+	// dnsSet is protected by wgLock.
+	dnsSet bool
+
+	// wgPunchPeer is the Pikopunch server, which is a peer that Rendezvous
+	// does not tell us about.
+	// wgPunchPeer is protected by wgLock.
+	wgPunchPeer *wgPeer
+
+	// wgEndpoints records the endpoint that was configured for each peer
+	// and where it came from, keyed by public key.
+	// wgEndpoints is protected by wgLock.
+	wgEndpoints map[wgtypes.Key]wgEndpoint
+
+	// punchCancel stops the Pikopunch client.
+	// punchCancel is protected by wgLock.
+	punchCancel context.CancelFunc
+
+	// dnsMap is a mapping between DNS keys and an IP.
+	// It is replaced whole by dnsUpdatePeers, and is protected by dnsMut.
+	dnsMap map[string]dnsRecord
+
+	// dnsNetworks holds the DNS names of our networks, and dnsConflicts
+	// the names that are not published because several devices use them.
+	// They are protected by dnsMut.
+	dnsNetworks  map[string]bool
+	dnsConflicts map[string]bool
+	dnsMut       sync.RWMutex
+}
+
+// instances holds every instance, starting with the one from the config file
+// that pikonoded was started with.
+// It is not modified once the daemon has started; adding or removing
+// instances requires a restart.
+var instances []*instance
+
+func newInstance(name string, conf *config.File) *instance {
+	return &instance{
+		Name:        name,
+		conf:        conf,
+		wgEndpoints: map[wgtypes.Key]wgEndpoint{},
+		dnsMap:      map[string]dnsRecord{},
+	}
+}
+
+// logf logs a message about the instance, naming it if there is more than
+// one.
+func (in *instance) logf(f string, d ...any) {
+	if len(instances) > 1 {
+		f = in.Name + ": " + f
+	}
+	log.Printf(f, d...)
+}
+
+// config returns the config of the instance.
+func (in *instance) config() config.Config {
+	in.confMu.RLock()
+	defer in.confMu.RUnlock()
+
+	return in.conf.Config
+}
+
+// engineConfig returns the config of the engine of an instance with the
+// config c.
+func (in *instance) engineConfig(c config.Config) piko.Config {
+	var creds api.Credentials
+	if user, pw, ok := c.Login(); ok {
+		creds = api.PasswordCredentials{Username: user, Password: pw}
+	}
+
+	return piko.Config{
+		Rendezvous: c.Rendezvous,
+		DeviceID:   c.DeviceID,
+		Token:      c.Token,
+		ListenPort: c.ListenPort,
+
+		Credentials: creds,
+		OnToken:     in.saveToken,
+	}
+}
+
+// self returns our device as the engine knows it.
+func (in *instance) self() api.Device {
+	in.eng.Lock()
+	defer in.eng.Unlock()
+
+	return *in.eng.Self()
+}
+
+// loadInstances loads the config file that pikonoded was started with, along
+// with those of the profiles that it lists in Instances.
+func loadInstances() ([]*instance, error) {
+	if err := config.ReadConfigFile(); err != nil {
+		return nil, err
+	}
+
+	main := config.Current()
+	insts := []*instance{newInstance(config.CurrentProfile(), main)}
+
+	for _, v := range main.Config.Instances {
+		path, err := config.ProfilePath(v)
+		if err != nil {
+			return nil, err
+		} else if path == main.Path {
+			return nil, fmt.Errorf("instance %q is the profile that pikonoded was started with", v)
+		}
+
+		f, err := config.Open(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("instance %q has no config file at %s", v, path)
+		} else if err != nil {
+			return nil, err
+		}
+
+		insts = append(insts, newInstance(v, f))
+	}
+
+	if err := checkInstances(insts); err != nil {
+		return nil, err
+	}
+
+	return insts, nil
+}
+
+// checkInstances makes sure that instances do not get in each other's way,
+// then picks a listen port for those that do not have one.
+func checkInstances(insts []*instance) error {
+	names := map[string]bool{}
+	ifaces := map[string]string{}
+	ports := map[int]string{}
+	suffixes := map[string]string{}
+
+	for _, v := range insts {
+		c := v.conf.Config
+
+		if names[v.Name] {
+			return fmt.Errorf("instance %q is listed more than once", v.Name)
+		}
+		names[v.Name] = true
+
+		if other, ok := ifaces[c.InterfaceName]; ok {
+			return fmt.Errorf("instances %q and %q both use interface %s", other, v.Name, c.InterfaceName)
+		}
+		ifaces[c.InterfaceName] = v.Name
+
+		if other, ok := suffixes[c.DNSSuffix]; ok {
+			return fmt.Errorf("instances %q and %q both use DNS suffix %s", other, v.Name, c.DNSSuffix)
+		}
+		suffixes[c.DNSSuffix] = v.Name
+
+		if c.ListenPort == 0 {
+			continue
+		} else if other, ok := ports[c.ListenPort]; ok {
+			return fmt.Errorf("instances %q and %q both use listen port %d", other, v.Name, c.ListenPort)
+		}
+		ports[c.ListenPort] = v.Name
+	}
+
+	// Fetch a port if we need to
+	for _, v := range insts {
+		for v.conf.Config.ListenPort == 0 || ports[v.conf.Config.ListenPort] != v.Name {
+			port := int(rand.Uint32()|(1<<10)) & 0xFFFF
+			if _, ok := ports[port]; !ok {
+				v.conf.Config.ListenPort = port
+				ports[port] = v.Name
+			}
+		}
+	}
+
+	return nil
+}
+
+// start brings up the interface of the instance and connects it to its
+// Rendezvous server.
+func (in *instance) start(ctx context.Context) error {
+	var err error
+	if in.eng, err = piko.NewEngine(in.engineConfig(in.config())); err != nil {
+		return fmt.Errorf("failed to start engine: %w", err)
+	}
+
+	if err := in.startWireguard(); err != nil {
+		return fmt.Errorf("failed to start wireguard: %w", err)
+	}
+
+	in.wgLock.Lock()
+	in.wgDev.SetState(true)
+	in.wgLock.Unlock()
+
+	in.eng.OnJoin(in.wgOnJoin)
+	in.eng.OnLeave(in.wgOnLeave)
+	in.eng.OnUpdate(in.wgOnUpdate)
+	in.eng.OnRebuild(in.wgOnRebuild)
+
+	in.eng.OnJoin(in.dnsOnJoin)
+	in.eng.OnLeave(in.dnsOnLeave)
+	in.eng.OnUpdate(in.dnsOnUpdate)
+	in.eng.OnRebuild(in.dnsOnRebuild)
+
+	waitGroup.Add(1)
+	go func() {
+		defer waitGroup.Done()
+		in.logEvents(ctx)
+	}()
+
+	if err := in.eng.Connect(); err != nil {
+		return fmt.Errorf("failed to connect to Rendezvous server: %w", err)
+	}
+
+	if err := in.startPikopunch(ctx); err != nil {
+		return err
+	}
+
+	in.bringupDns()
+
+	return nil
+}
+
+// stop takes down the interface of the instance.
+//
+// The engine must have been closed first, so that nothing else touches the
+// interface.
+func (in *instance) stop() {
+	in.wgLock.Lock()
+	defer in.wgLock.Unlock()
+
+	if in.wgDev == nil {
+		return
+	}
+
+	if in.dnsSet {
+		in.takedownDns()
+	}
+
+	in.wgDev.SetState(false)
+	in.wgDev.Close()
+	in.wgDev = nil
+}
+
+// logEvents logs the state of the connection to the Rendezvous server.
+func (in *instance) logEvents(ctx context.Context) {
+	evs, unsubscribe := in.eng.Subscribe(16)
+	defer unsubscribe()
+
+	for {
+		select {
+		case ev := <-evs:
+			switch ev.Type {
+			case piko.EventConnect:
+				in.logf("Connected to rendezvous server.")
+			case piko.EventDisconnect:
+				in.logf("Disconnected from rendezvous server. Error: %v", ev.Error)
+				in.logf("Reconnecting to rendezvous in %v", ev.Delay)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
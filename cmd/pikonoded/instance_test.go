@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mca3/pikonode/internal/config"
+)
+
+func testInstance(name, iface, suffix string, port int) *instance {
+	c := config.Default()
+	c.InterfaceName, c.DNSSuffix, c.ListenPort = iface, suffix, port
+
+	return newInstance(name, &config.File{Config: c})
+}
+
+func TestCheckInstances(t *testing.T) {
+	tests := []struct {
+		name  string
+		insts []*instance
+		err   string
+	}{
+		{"name", []*instance{testInstance("a", "pn0", "pn", 0), testInstance("a", "pn1", "cust", 0)}, "listed more than once"},
+		{"interface", []*instance{testInstance("a", "pn0", "pn", 0), testInstance("b", "pn0", "cust", 0)}, "interface pn0"},
+		{"suffix", []*instance{testInstance("a", "pn0", "pn", 0), testInstance("b", "pn1", "pn", 0)}, "DNS suffix pn"},
+		{"port", []*instance{testInstance("a", "pn0", "pn", 1234), testInstance("b", "pn1", "cust", 1234)}, "listen port 1234"},
+	}
+
+	for _, v := range tests {
+		t.Run(v.name, func(t *testing.T) {
+			if err := checkInstances(v.insts); err == nil || !strings.Contains(err.Error(), v.err) {
+				t.Errorf("err = %v, expected it to mention %q", err, v.err)
+			}
+		})
+	}
+
+	insts := []*instance{
+		testInstance("a", "pn0", "pn", 0),
+		testInstance("b", "pn1", "cust", 1234),
+		testInstance("c", "pn2", "other", 0),
+	}
+
+	if err := checkInstances(insts); err != nil {
+		t.Fatalf("checkInstances = %v", err)
+	}
+
+	seen := map[int]bool{}
+	for _, v := range insts {
+		port := v.conf.Config.ListenPort
+		if port == 0 || seen[port] {
+			t.Errorf("instance %q was given listen port %d", v.Name, port)
+		}
+		seen[port] = true
+	}
+
+	if port := insts[1].conf.Config.ListenPort; port != 1234 {
+		t.Errorf("listen port changed to %d", port)
+	}
+}
@@ -8,11 +8,13 @@ import (
 	"time"
 )
 
-func fetchEndpoint(ctx context.Context, ppaddr string) (string, error) {
+// fetchEndpoint asks the Pikopunch server at ppaddr what our endpoint is,
+// talking to it from ourIP.
+func fetchEndpoint(ctx context.Context, ourIP, ppaddr string) (string, error) {
 	ctx, cancel := context.WithTimeout(ctx, time.Second*30)
 	defer cancel()
 
-	ourAddr, err := net.ResolveUDPAddr("udp6", fmt.Sprintf("[%s]:0", ourDevice.IP))
+	ourAddr, err := net.ResolveUDPAddr("udp6", fmt.Sprintf("[%s]:0", ourIP))
 	if err != nil {
 		return "", err
 	}
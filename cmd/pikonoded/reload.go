@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"sync"
+	"syscall"
+
+	"github.com/mca3/pikonode/internal/config"
+	"github.com/mca3/pikonode/internal/control"
+)
+
+// reloadSignals are the signals that make the daemon re-read its config.
+var reloadSignals = []os.Signal{syscall.SIGHUP}
+
+// liveFields are the config fields that reload applies without restarting.
+// Changes to every other field are only noted.
+var liveFields = map[string]bool{
+	"Rendezvous":     true,
+	"Token":          true,
+	"Username":       true,
+	"Password":       true,
+	"ListenPort":     true,
+	"DNSSuffix":      true,
+	"DNSFallback":    true,
+	"DNSNegativeTTL": true,
+	"Discovery":      true,
+}
+
+// engineFields are the config fields that the engine is reconfigured for.
+var engineFields = []string{"Rendezvous", "Token", "Username", "Password", "ListenPort"}
+
+// mainFields are the config fields that are only read from the config file
+// that pikonoded was started with.
+var mainFields = map[string]bool{
+	"Instances":      true,
+	"DNSFallback":    true,
+	"DNSNegativeTTL": true,
+}
+
+// service is a goroutine shared by every instance, which is restarted when
+// the config that it was started with changes.
+type service struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// The services started by startup.
+// They are replaced by reload, and are protected by reloadMut.
+var (
+	dnsService    *service
+	discovService *service
+)
+
+// reloadMut serializes reloads.
+var reloadMut sync.Mutex
+
+// startService runs f in a goroutine until ctx is done or the service is
+// stopped.
+func startService(ctx context.Context, name string, f func(ctx context.Context) error) *service {
+	ctx, cancel := context.WithCancel(ctx)
+	s := &service{cancel: cancel, done: make(chan struct{})}
+
+	waitGroup.Add(1)
+	go func() {
+		defer waitGroup.Done()
+		defer close(s.done)
+
+		if err := f(ctx); err != nil {
+			log.Printf("%s failed: %v", name, err)
+		}
+	}()
+
+	return s
+}
+
+// stop stops the service and waits for it to exit.
+// Stopping a nil service does nothing.
+func (s *service) stop() {
+	if s == nil {
+		return
+	}
+
+	s.cancel()
+	<-s.done
+}
+
+// changedFields returns the names of the fields that differ between a and b.
+func changedFields(a, b config.Config) []string {
+	changed := []string{}
+
+	av, bv := reflect.ValueOf(a), reflect.ValueOf(b)
+	for i := 0; i < av.NumField(); i++ {
+		if !reflect.DeepEqual(av.Field(i).Interface(), bv.Field(i).Interface()) {
+			changed = append(changed, av.Type().Field(i).Name)
+		}
+	}
+
+	return changed
+}
+
+// hasAny determines if list contains any of fields.
+func hasAny(list []string, fields ...string) bool {
+	for _, v := range list {
+		for _, f := range fields {
+			if v == f {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// field names a config field of the instance for a control.ReloadResult.
+func (in *instance) field(name string) string {
+	if len(instances) > 1 {
+		return in.Name + ": " + name
+	}
+	return name
+}
+
+// reload re-reads the config file of every instance and applies the fields in
+// liveFields, leaving the WireGuard interfaces and their peers up.
+//
+// Nothing is changed if any config file is invalid.
+// Fields that cannot be changed without restarting keep their old values.
+func reload(ctx context.Context) (control.ReloadResult, error) {
+	reloadMut.Lock()
+	defer reloadMut.Unlock()
+
+	if ctx.Err() != nil {
+		return control.ReloadResult{}, errors.New("shutting down")
+	}
+
+	res := control.ReloadResult{Applied: []string{}, Restart: []string{}}
+	files := make([]*config.File, len(instances))
+	changes := make([][]string, len(instances))
+	trial := make([]*instance, len(instances))
+
+	for i, v := range instances {
+		f, err := config.Open(v.conf.Path)
+		if err != nil {
+			return control.ReloadResult{}, fmt.Errorf("instance %q: %w", v.Name, err)
+		}
+
+		old := v.config()
+
+		// Keep the port that we picked if there is none.
+		if f.Config.ListenPort == 0 {
+			f.Keep(old, "ListenPort")
+		}
+
+		live, keep := []string{}, []string{}
+		for _, name := range changedFields(old, f.Config) {
+			if i > 0 && mainFields[name] {
+				continue
+			} else if !liveFields[name] {
+				res.Restart = append(res.Restart, v.field(name))
+				keep = append(keep, name)
+				continue
+			}
+
+			live = append(live, name)
+		}
+
+		// Keep running with what we have.
+		f.Keep(old, keep...)
+
+		files[i], changes[i] = f, live
+		trial[i] = newInstance(v.Name, f)
+	}
+
+	if err := checkInstances(trial); err != nil {
+		return control.ReloadResult{}, err
+	}
+
+	errs := []error{}
+	for i, v := range instances {
+		if err := v.reload(ctx, files[i], changes[i]); err != nil {
+			if len(instances) > 1 {
+				err = fmt.Errorf("instance %q: %w", v.Name, err)
+			}
+			errs = append(errs, err)
+
+			// The instance still runs with its old config, so
+			// nothing that it shares needs to restart.
+			changes[i] = nil
+			continue
+		}
+
+		for _, name := range changes[i] {
+			res.Applied = append(res.Applied, v.field(name))
+		}
+	}
+
+	// Restart the services whose config has changed.
+	for i, v := range changes {
+		if hasAny(v, "DNSSuffix") || (i == 0 && hasAny(v, "DNSFallback", "DNSNegativeTTL")) {
+			dnsService.stop()
+			dnsService = startService(ctx, "DNS server", listenDNS)
+			break
+		}
+	}
+
+	for _, v := range changes {
+		if hasAny(v, "Discovery", "ListenPort") {
+			discovService.stop()
+			discovService = nil
+			break
+		}
+	}
+
+	if discovService != nil && !discoveryEnabled() {
+		discovService.stop()
+		discovService = nil
+	} else if discovService == nil && discoveryEnabled() {
+		discovService = startService(ctx, "local discovery", listenBroadcast)
+	}
+
+	for _, v := range res.Applied {
+		log.Printf("Applied new %s.", v)
+	}
+	for _, v := range res.Restart {
+		log.Printf("Changed %s; restart pikonoded to apply it.", v)
+	}
+
+	return res, errors.Join(errs...)
+}
+
+// reload applies the fields named by changed from the config file f, then
+// makes it the config of the instance.
+func (in *instance) reload(ctx context.Context, f *config.File, changed []string) error {
+	old := in.config()
+	c := f.Config
+
+	if c.ListenPort != old.ListenPort {
+		in.wgLock.Lock()
+		err := in.wgDev.SetListenPort(uint16(c.ListenPort))
+		in.wgLock.Unlock()
+
+		if err != nil {
+			return fmt.Errorf("failed to change listen port: %w", err)
+		}
+		in.logf("Listen port is now %d.", c.ListenPort)
+	}
+
+	if hasAny(changed, engineFields...) {
+		if err := in.eng.Reconfigure(in.engineConfig(c)); err != nil {
+			if c.ListenPort != old.ListenPort {
+				in.wgLock.Lock()
+				in.wgDev.SetListenPort(uint16(old.ListenPort))
+				in.wgLock.Unlock()
+			}
+			return fmt.Errorf("failed to reconnect to the Rendezvous server: %w", err)
+		}
+	}
+
+	in.confMu.Lock()
+	in.conf = f
+	in.confMu.Unlock()
+
+	if hasAny(changed, "Rendezvous") {
+		// The new server may have its own Pikopunch server.
+		if err := in.startPikopunch(ctx); err != nil {
+			in.logf("%v", err)
+		}
+	}
+
+	if hasAny(changed, "Rendezvous", "Discovery") {
+		// Drop the old Pikopunch server, and pick endpoints again now
+		// that local discovery may have been turned on or off.
+		in.eng.Lock()
+		in.wgUpdatePeers()
+		in.eng.Unlock()
+	}
+
+	return nil
+}
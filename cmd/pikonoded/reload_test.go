@@ -0,0 +1,22 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mca3/pikonode/internal/config"
+)
+
+func TestChangedFields(t *testing.T) {
+	a := config.Default()
+	if got := changedFields(a, a); len(got) != 0 {
+		t.Errorf("changedFields of the same config = %v", got)
+	}
+
+	b := a
+	b.ListenPort = 1234
+	b.Instances = []string{"work"}
+	if got, want := changedFields(a, b), []string{"ListenPort", "Instances"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("changedFields = %v, expected %v", got, want)
+	}
+}
@@ -7,14 +7,27 @@ import (
 	"os"
 
 	"github.com/mca3/pikonode/api"
-	"github.com/mca3/pikonode/internal/config"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
-var ourDevice api.Device
+// saveToken saves a token that was refreshed to the config file.
+func (in *instance) saveToken(token string) {
+	in.logf("Rendezvous token was refreshed.")
 
-func newDevice(ctx context.Context) (api.Device, error) {
-	if config.Cfg.PrivateKey != "" {
+	in.confMu.Lock()
+	defer in.confMu.Unlock()
+
+	if err := in.conf.SaveToken(token); err != nil {
+		in.logf("failed to save new token: %v", err)
+	}
+}
+
+func (in *instance) newDevice(ctx context.Context) (api.Device, error) {
+	in.confMu.Lock()
+	defer in.confMu.Unlock()
+
+	c := &in.conf.Config
+	if c.PrivateKey != "" {
 		return api.Device{}, fmt.Errorf("refusing to make a new device with an already specified private key")
 	}
 
@@ -25,8 +38,8 @@ func newDevice(ctx context.Context) (api.Device, error) {
 
 	pubKey := privKey.PublicKey()
 
-	config.Cfg.PublicKey = pubKey.String()
-	config.Cfg.PrivateKey = privKey.String()
+	c.PublicKey = pubKey.String()
+	c.PrivateKey = privKey.String()
 
 	/*
 		wgChan <- wgMsg{
@@ -40,24 +53,30 @@ func newDevice(ctx context.Context) (api.Device, error) {
 		hostname = "<unknown>"
 	}
 
-	d, err := eng.API().NewDevice(ctx, hostname, config.Cfg.PublicKey)
+	d, err := in.eng.API().NewDevice(ctx, hostname, c.PublicKey)
 	if err == nil {
-		config.Cfg.DeviceID = d.ID
-		if err := config.SaveConfigFile(); err != nil {
+		c.DeviceID = d.ID
+		if err := in.conf.Save(); err != nil {
 			return d, fmt.Errorf("failed to save config: %w", err)
 		}
 	}
 	return d, err
 }
 
-func getDevice(ctx context.Context) (api.Device, error) {
-	if config.Cfg.DeviceID == 0 {
-		return newDevice(ctx)
+func (in *instance) getDevice(ctx context.Context) (api.Device, error) {
+	c := in.config()
+	if c.DeviceID == 0 {
+		return in.newDevice(ctx)
 	}
 
-	dev, err := eng.API().Device(ctx, config.Cfg.DeviceID)
-	if errors.Is(err, api.ErrNotFound) {
-		return newDevice(ctx)
+	dev, err := in.eng.API().Device(ctx, c.DeviceID)
+	switch {
+	case errors.Is(err, api.ErrNotFound):
+		return in.newDevice(ctx)
+	case errors.Is(err, api.ErrUnauthorized):
+		return dev, fmt.Errorf("the Rendezvous server rejected our token; log in again with pikonodectl: %w", err)
+	case errors.Is(err, api.ErrForbidden):
+		return dev, fmt.Errorf("device %d belongs to another user; check DeviceID in the config file: %w", c.DeviceID, err)
 	}
 
 	return dev, err
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/mca3/pikonode/internal/control"
+	"github.com/mca3/pikonode/net/dns/resolvconf"
+	"github.com/mca3/pikonode/net/ifctl"
+)
+
+// shutdownSignals are the signals that stop the daemon.
+// systemd sends SIGTERM.
+var shutdownSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+// shutdownTimeout is how long each step of shutdown may take before it is
+// given up on.
+const shutdownTimeout = 5 * time.Second
+
+// waitTimeout runs f, giving up on waiting for it to return after
+// shutdownTimeout.
+func waitTimeout(what string, f func()) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(shutdownTimeout):
+		log.Printf("Timed out waiting for %s; continuing anyway.", what)
+	}
+}
+
+// shutdown stops everything that startup started, in reverse order.
+//
+// Everything that runs on its own is stopped first so that nothing touches the
+// interfaces while they are being taken down.
+func shutdown(cancel context.CancelFunc) {
+	// Stops the control socket, DNS server, local discovery and Pikopunch.
+	cancel()
+	waitTimeout("background tasks", waitGroup.Wait)
+
+	for i := len(instances) - 1; i >= 0; i-- {
+		in := instances[i]
+
+		if in.eng != nil {
+			waitTimeout("the Rendezvous connection of "+in.Name, in.eng.Close)
+		}
+		waitTimeout("interface of "+in.Name+" to go down", in.stop)
+	}
+
+	log.Printf("Exiting.")
+}
+
+// cleanupStale removes interfaces and DNS configuration left behind by a
+// pikonoded that did not exit cleanly, as the interfaces could not be created
+// again otherwise.
+//
+// Interfaces used by another running pikonoded are left alone.
+func cleanupStale(dir string, insts []*instance) {
+	inUse := liveInterfaces(dir)
+
+	for _, v := range insts {
+		name := v.config().InterfaceName
+		if inUse[name] {
+			v.logf("Interface %s is in use by another pikonoded.", name)
+			continue
+		}
+
+		ifc, err := ifctl.From(name)
+		if err != nil {
+			// Nothing was left behind.
+			continue
+		}
+
+		v.logf("Removing interface %s left behind by a previous run.", name)
+
+		// There may not have been any DNS configuration.
+		_ = resolvconf.UnsetDNS(ifc)
+
+		if err := ifc.Delete(); err != nil {
+			v.logf("failed to remove interface %s: %v", name, err)
+		}
+	}
+}
+
+// liveInterfaces asks every other pikonoded with a control socket in dir
+// which interfaces it is using.
+//
+// Sockets that nothing is listening on any more are removed.
+func liveInterfaces(dir string) map[string]bool {
+	inUse := map[string]bool{}
+
+	socks, err := control.FindSockets(dir)
+	if err != nil {
+		return inUse
+	}
+
+	for _, path := range socks {
+		if path == unixSocket {
+			continue
+		}
+
+		func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			c, err := control.Dial(ctx, path)
+			if errors.Is(err, syscall.ECONNREFUSED) {
+				log.Printf("Removing control socket %s left behind by a previous run.", path)
+				os.Remove(path)
+				return
+			} else if err != nil {
+				return
+			}
+			defer c.Close()
+
+			sts := []control.Status{}
+			if err := c.Call(ctx, control.MethodInstances, nil, &sts); err != nil {
+				// Daemons from before instances existed.
+				st := control.Status{}
+				if err := c.Call(ctx, control.MethodStatus, nil, &st); err != nil {
+					return
+				}
+				sts = append(sts, st)
+			}
+
+			for _, v := range sts {
+				inUse[v.Interface] = true
+			}
+		}()
+	}
+
+	return inUse
+}
@@ -2,11 +2,17 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
 	"net"
-	/*
-		"errors"
-		"log"
-	*/)
+	"os"
+	"sort"
+
+	"github.com/mca3/pikonode/api"
+	"github.com/mca3/pikonode/internal/control"
+)
 
 const (
 	unixMode = 0o770
@@ -14,51 +20,288 @@ const (
 
 var unixSocket = ""
 
-func handle(c net.Conn) {
+func handle(ctx context.Context, c net.Conn) {
 	defer waitGroup.Done()
+
+	// Hang up on clients that are still connected when we exit.
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-done:
+		}
+	}()
+
+	handler := func(method control.Method, params json.RawMessage) (any, error) {
+		return handleControl(ctx, method, params)
+	}
+
+	if err := control.ServeConn(c, handler); err != nil && ctx.Err() == nil {
+		log.Printf("control connection failed: %v", err)
+	}
+}
+
+// handleControl answers a single request made over the UNIX socket.
+func handleControl(ctx context.Context, method control.Method, params json.RawMessage) (any, error) {
+	switch method {
+	case control.MethodReload:
+		return reload(ctx)
+	case control.MethodInstances:
+		return controlInstances(), nil
+	case control.MethodDiscovery:
+		return controlDiscovery(), nil
+	case control.MethodStatus, control.MethodPeers, control.MethodNetworks, control.MethodDNS, control.MethodWireGuard:
+		// Handled below.
+	default:
+		return nil, fmt.Errorf("unknown method %q", method)
+	}
+
+	in, err := findInstance(params)
+	if err != nil {
+		return nil, err
+	}
+
+	switch method {
+	case control.MethodStatus:
+		return in.controlStatus(), nil
+	case control.MethodPeers:
+		return in.controlPeers()
+	case control.MethodNetworks:
+		return in.controlNetworks(), nil
+	case control.MethodDNS:
+		return in.controlDNS(), nil
+	default:
+		return in.controlWireGuard()
+	}
+}
+
+// findInstance returns the instance named by control.InstanceParams.
+func findInstance(params json.RawMessage) (*instance, error) {
+	p := control.InstanceParams{}
+	if len(params) != 0 {
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, fmt.Errorf("invalid parameters: %w", err)
+		}
+	}
+
+	if p.Instance == "" {
+		return instances[0], nil
+	}
+
+	for _, v := range instances {
+		if v.Name == p.Instance {
+			return v, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no instance named %q", p.Instance)
+}
+
+func controlInstances() []control.Status {
+	sts := make([]control.Status, 0, len(instances))
+	for _, v := range instances {
+		sts = append(sts, v.controlStatus())
+	}
+	return sts
+}
+
+func (in *instance) controlStatus() control.Status {
+	c := in.config()
+
+	in.eng.Lock()
+	defer in.eng.Unlock()
+
+	return control.Status{
+		PID:        os.Getpid(),
+		Started:    startTime,
+		Instance:   in.Name,
+		Rendezvous: c.Rendezvous,
+		Interface:  c.InterfaceName,
+		ListenPort: c.ListenPort,
+		Device:     *in.eng.Self(),
+		Connected:  in.eng.Connected(),
+		Networks:   len(in.eng.Networks()),
+		Peers:      len(in.eng.Peers()),
+	}
+}
+
+func (in *instance) controlPeers() ([]control.Peer, error) {
+	in.eng.Lock()
+	devs := append([]api.Device(nil), in.eng.Peers()...)
+	in.eng.Unlock()
+
+	in.wgLock.Lock()
+	defer in.wgLock.Unlock()
+
+	if in.wgDev == nil {
+		return nil, errors.New("the interface is down")
+	}
+
+	stats, err := in.wgDev.Peers()
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch WireGuard peers: %w", err)
+	}
+
+	peers := make([]control.Peer, 0, len(devs))
+	for _, d := range devs {
+		p := control.Peer{
+			ID:        d.ID,
+			Name:      d.Name,
+			IP:        d.IP,
+			PublicKey: d.PublicKey,
+			Source:    control.SourceRendezvous,
+		}
+
+		for _, v := range stats {
+			if v.PublicKey.String() != d.PublicKey {
+				continue
+			}
+
+			if ep, ok := in.wgEndpoints[v.PublicKey]; ok {
+				p.Endpoint = ep.Endpoint
+				p.Source = ep.Source
+			}
+
+			p.LastHandshake = v.LastHandshakeTime
+			p.RxBytes = v.ReceiveBytes
+			p.TxBytes = v.TransmitBytes
+			break
+		}
+
+		peers = append(peers, p)
+	}
+
+	return peers, nil
+}
+
+func (in *instance) controlNetworks() []api.Network {
+	in.eng.Lock()
+	defer in.eng.Unlock()
+
+	return append([]api.Network(nil), in.eng.Networks()...)
+}
+
+func controlDiscovery() []control.DiscoveredPeer {
+	seenMut.Lock()
+	defer seenMut.Unlock()
+
+	peers := make([]control.DiscoveredPeer, 0, len(seenPeers))
+	for k, v := range seenPeers {
+		peers = append(peers, control.DiscoveredPeer{
+			PublicKey: k,
+			Endpoint:  v.Endpoint,
+			LastSeen:  v.LastSeen,
+			Valid:     v.Valid(),
+		})
+	}
+
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].PublicKey < peers[j].PublicKey
+	})
+
+	return peers
+}
+
+func (in *instance) controlDNS() []control.DNSRecord {
+	in.dnsMut.RLock()
+	defer in.dnsMut.RUnlock()
+
+	recs := make([]control.DNSRecord, 0, len(in.dnsMap))
+	for k, v := range in.dnsMap {
+		recs = append(recs, control.DNSRecord{Name: k, IP: v.IP.String()})
+	}
+
+	sort.Slice(recs, func(i, j int) bool {
+		return recs[i].Name < recs[j].Name
+	})
+
+	return recs
+}
+
+func (in *instance) controlWireGuard() ([]control.WireGuardPeer, error) {
+	in.wgLock.Lock()
+	defer in.wgLock.Unlock()
+
+	if in.wgDev == nil {
+		return nil, errors.New("the interface is down")
+	}
+
+	stats, err := in.wgDev.Peers()
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch WireGuard peers: %w", err)
+	}
+
+	peers := make([]control.WireGuardPeer, 0, len(stats))
+	for _, v := range stats {
+		p := control.WireGuardPeer{
+			PublicKey:     v.PublicKey.String(),
+			AllowedIPs:    make([]string, 0, len(v.AllowedIPs)),
+			LastHandshake: v.LastHandshakeTime,
+			RxBytes:       v.ReceiveBytes,
+			TxBytes:       v.TransmitBytes,
+		}
+
+		if v.Endpoint != nil {
+			p.Endpoint = v.Endpoint.String()
+		}
+
+		for _, ip := range v.AllowedIPs {
+			p.AllowedIPs = append(p.AllowedIPs, ip.String())
+		}
+
+		peers = append(peers, p)
+	}
+
+	return peers, nil
 }
 
 // bindUnix creates the UNIX socket that allows programs to communicate with
 // this daemon.
 func bindUnix(ctx context.Context) error {
-	/*
-		lc := net.ListenConfig{}
+	lc := net.ListenConfig{}
 
-		l, err := lc.Listen(ctx, "unix", unixSocket)
-		if err != nil {
-			return err
-		}
+	l, err := lc.Listen(ctx, "unix", unixSocket)
+	if err != nil {
+		return err
+	}
 
-		waitGroup.Add(2)
+	if err := os.Chmod(unixSocket, unixMode); err != nil {
+		l.Close()
+		return err
+	}
 
-		go func() {
-			defer waitGroup.Done()
+	waitGroup.Add(2)
 
-			<-ctx.Done()
-			l.Close()
-		}()
+	go func() {
+		defer waitGroup.Done()
 
-		go func() {
-			defer waitGroup.Done()
-			defer l.Close()
+		<-ctx.Done()
+		l.Close()
+	}()
 
-			for {
-				c, err := l.Accept()
-				if errors.Is(err, net.ErrClosed) {
-					// Context is done
-					return
-				} else if err != nil {
-					log.Printf("Couldn't accept: %v", err)
-					return
-				}
+	go func() {
+		defer waitGroup.Done()
+		defer l.Close()
 
-				waitGroup.Add(1)
-				go handle(c)
+		for {
+			c, err := l.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				// Context is done
+				return
+			} else if err != nil {
+				log.Printf("Couldn't accept: %v", err)
+				return
 			}
-		}()
 
-		log.Printf("UNIX socket is at %v", unixSocket)
-	*/
+			waitGroup.Add(1)
+			go handle(ctx, c)
+		}
+	}()
+
+	log.Printf("UNIX socket is at %v", unixSocket)
 
 	return nil
 }
@@ -1,138 +1,251 @@
 package main
 
 import (
-	"log"
-	"sync"
+	"net"
 
 	"github.com/mca3/pikonode/api"
-	"github.com/mca3/pikonode/internal/config"
+	"github.com/mca3/pikonode/internal/control"
 	"github.com/mca3/pikonode/net/wg"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
-var wgDev wg.Device
-var wgLock sync.Mutex
-var wgLastPeers []api.Device
+// wgPeer is the configuration we want a single WireGuard peer to have.
+type wgPeer struct {
+	Key      wgtypes.Key
+	IP       *net.IPNet
+	Endpoint *net.UDPAddr
+	Source   control.Source
+}
+
+type wgEndpoint struct {
+	Endpoint string
+	Source   control.Source
+}
+
+// wgAddPeer adds a peer to the WireGuard device, remembering where its
+// endpoint was learned from.
+//
+// wgLock must be held.
+func (in *instance) wgAddPeer(p wgPeer) error {
+	if err := in.wgDev.AddPeer(p.IP, p.Endpoint, p.Key); err != nil {
+		return err
+	}
+
+	ep := wgEndpoint{Source: p.Source}
+	if p.Endpoint != nil {
+		ep.Endpoint = p.Endpoint.String()
+	}
+	in.wgEndpoints[p.Key] = ep
+
+	return nil
+}
 
 // startWireguard creates the WireGuard interface.
-func startWireguard() error {
-	wgLock.Lock()
-	defer wgLock.Unlock()
+func (in *instance) startWireguard() error {
+	in.wgLock.Lock()
+	defer in.wgLock.Unlock()
+
+	c := in.config()
 
-	key, err := wg.ParseKey(config.Cfg.PrivateKey)
+	key, err := wg.ParseKey(c.PrivateKey)
 	if err != nil {
 		return err
 	}
 
-	wgDev, err = wg.New(config.Cfg.InterfaceName)
+	dev, err := wg.New(c.InterfaceName, wg.Backend(c.Backend))
 	if err != nil {
 		return err
 	}
 
-	if err := wgDev.SetKey(key); err != nil {
-		wgDev.Close()
+	if err := dev.SetKey(key); err != nil {
+		dev.Close()
 		return err
 	}
 
-	if err := wgDev.SetListenPort(uint16(config.Cfg.ListenPort)); err != nil {
-		wgDev.Close()
+	if err := dev.SetListenPort(uint16(c.ListenPort)); err != nil {
+		dev.Close()
 		return err
 	}
 
-	log.Printf("WireGuard interface is %v. Listen port is %d.", config.Cfg.InterfaceName, config.Cfg.ListenPort)
+	in.wgDev = dev
+	in.logf("WireGuard interface is %v. Listen port is %d.", c.InterfaceName, c.ListenPort)
 
 	return nil
 }
 
-func wgOnJoin(nw *api.Network, dev *api.Device) {
-	wgUpdatePeers()
+func (in *instance) wgOnJoin(nw *api.Network, dev *api.Device) {
+	in.wgUpdatePeers()
 }
 
-func wgOnLeave(nw *api.Network, dev *api.Device) {
-	wgUpdatePeers()
+func (in *instance) wgOnLeave(nw *api.Network, dev *api.Device) {
+	in.wgUpdatePeers()
 }
 
-func wgOnUpdate(dev *api.Device) {
-	wgLock.Lock()
-	defer wgLock.Unlock()
-
-	// Largely TODO
+func (in *instance) wgOnUpdate(dev *api.Device) {
+	in.wgUpdatePeers()
+}
 
-	key, err := wg.ParseKey(dev.PublicKey)
-	if err != nil {
-		// shouldn't happen.
-		return
+func (in *instance) wgOnRebuild() {
+	in.wgLock.Lock()
+	if in.wgDev != nil {
+		in.wgDev.SetIP(mustParseIPNet(in.eng.Self().IP))
 	}
+	in.wgLock.Unlock()
 
-	wgDev.AddPeer(mustParseIPNet(dev.IP), mustParseUDPAddr(dev.Endpoint), key)
+	in.wgUpdatePeers()
 }
 
-func wgOnRebuild() {
-	wgDev.SetIP(mustParseIPNet(eng.Self().IP))
-	wgUpdatePeers()
+// wgDesiredPeers computes the configuration that every WireGuard peer should
+// have from the peers known to the engine, preferring endpoints found through
+// local discovery.
+//
+// wgLock must be held.
+func (in *instance) wgDesiredPeers(peers []api.Device) map[wgtypes.Key]wgPeer {
+	desired := make(map[wgtypes.Key]wgPeer, len(peers)+1)
+	discovery := in.config().Discovery
+
+	for _, v := range peers {
+		key, err := wg.ParseKey(v.PublicKey)
+		if err != nil {
+			in.logf("peer %s has an invalid public key: %v", v.IP, err)
+			continue
+		}
+
+		p := wgPeer{
+			Key:      key,
+			IP:       mustParseIPNet(v.IP),
+			Endpoint: mustParseUDPAddr(v.Endpoint),
+			Source:   control.SourceRendezvous,
+		}
+
+		// Use the locally discovered endpoint if we have one
+		if lp, ok := localPeer(v.PublicKey); ok && discovery {
+			p.Endpoint = mustParseUDPAddr(lp.Endpoint)
+			p.Source = control.SourceLAN
+		}
+
+		desired[key] = p
+	}
+
+	if in.wgPunchPeer != nil {
+		desired[in.wgPunchPeer.Key] = *in.wgPunchPeer
+	}
+
+	return desired
 }
 
-// indexDevice returns the index of a device in a slice, or -1 otherwise.
-func indexDevice(dev api.Device, l []api.Device) int {
-	for i, v := range l {
-		if v.ID == dev.ID {
-			return i
+// wgNeedsUpdate determines if the current state of a peer differs from the
+// desired state.
+//
+// Endpoints are compared against the last endpoint that we configured rather
+// than the one reported by WireGuard, as WireGuard updates the endpoint by
+// itself when a peer roams and we don't want to undo that.
+func wgNeedsUpdate(want wgPeer, have wgtypes.Peer, configured wgEndpoint) bool {
+	if want.IP != nil {
+		if len(have.AllowedIPs) != 1 {
+			return true
+		}
+
+		ip := have.AllowedIPs[0]
+		if !ip.IP.Equal(want.IP.IP) || ip.Mask.String() != want.IP.Mask.String() {
+			return true
+		}
+	}
+
+	if want.Endpoint != nil {
+		if have.Endpoint == nil || configured.Endpoint != want.Endpoint.String() {
+			return true
 		}
 	}
 
-	return -1
+	return false
 }
 
-func wgUpdatePeers() {
-	wgLock.Lock()
-	defer wgLock.Unlock()
+// wgDiff compares the desired peers against the peers currently configured
+// on the interface, and returns the peers that need to be added or updated and
+// the keys of the peers that must be removed.
+func wgDiff(desired map[wgtypes.Key]wgPeer, current []wgtypes.Peer, configured map[wgtypes.Key]wgEndpoint) (set []wgPeer, remove []wgtypes.Key) {
+	seen := make(map[wgtypes.Key]bool, len(current))
 
-	peers := eng.Peers()
+	for _, v := range current {
+		seen[v.PublicKey] = true
 
-	// Find old devices
-	for _, v := range wgLastPeers {
-		devIndex := indexDevice(v, peers)
-		if devIndex != -1 {
-			// TODO: Determine if we should update them
+		want, ok := desired[v.PublicKey]
+		if !ok {
+			remove = append(remove, v.PublicKey)
 			continue
 		}
 
-		// Lost device
-		key, err := wg.ParseKey(v.PublicKey)
-		if err != nil {
-			// shouldn't happen.
-			continue
+		if wgNeedsUpdate(want, v, configured[v.PublicKey]) {
+			set = append(set, want)
 		}
+	}
 
-		log.Printf("removing peer %s", v.IP)
-		wgDev.RemovePeer(key)
+	for k, v := range desired {
+		if !seen[k] {
+			set = append(set, v)
+		}
 	}
 
-	// Find new devices
-	for _, v := range peers {
-		devIndex := indexDevice(v, wgLastPeers)
-		if devIndex != -1 {
+	return set, remove
+}
+
+// wgReconcile applies the minimal set of changes needed to make the interface
+// match the desired peers.
+//
+// wgLock must be held.
+func (in *instance) wgReconcile(desired map[wgtypes.Key]wgPeer) error {
+	current, err := in.wgDev.Peers()
+	if err != nil {
+		return err
+	}
+
+	set, remove := wgDiff(desired, current, in.wgEndpoints)
+
+	// Removals go first so that a peer that changed its key does not
+	// fight with its old self over the same IP.
+	for _, k := range remove {
+		in.logf("removing peer %s", k)
+
+		if err := in.wgDev.RemovePeer(k); err != nil {
+			in.logf("failed to remove peer %s: %v", k, err)
 			continue
 		}
+		delete(in.wgEndpoints, k)
+	}
 
-		// New device
-		key, err := wg.ParseKey(v.PublicKey)
-		if err != nil {
-			// shouldn't happen.
-			continue
+	for _, v := range set {
+		in.logf("setting peer %s (%s)", v.IP, v.Source)
+
+		if err := in.wgAddPeer(v); err != nil {
+			in.logf("failed to set peer %s: %v", v.IP, err)
 		}
+	}
 
-		// Use the locally discovered endpoint if we have one
-		endpoint := v.Endpoint
-		if lp, ok := localPeer(v.PublicKey); ok {
-			endpoint = lp.Endpoint
+	// Forget about the sources of peers that are already gone.
+	for k := range in.wgEndpoints {
+		if _, ok := desired[k]; !ok {
+			delete(in.wgEndpoints, k)
 		}
+	}
+
+	return nil
+}
 
-		log.Printf("adding peer %s", v.IP)
+// wgUpdatePeers reconciles the WireGuard interface with the state of the
+// engine.
+//
+// The engine must be locked.
+func (in *instance) wgUpdatePeers() {
+	in.wgLock.Lock()
+	defer in.wgLock.Unlock()
 
-		wgDev.AddPeer(mustParseIPNet(v.IP), mustParseUDPAddr(endpoint), key)
+	if in.wgDev == nil {
+		// Already taken down.
+		return
 	}
 
-	// Copy new peer list
-	wgLastPeers = wgLastPeers[:0]
-	wgLastPeers = append(wgLastPeers, peers...)
+	if err := in.wgReconcile(in.wgDesiredPeers(in.eng.Peers())); err != nil {
+		in.logf("failed to update peers: %v", err)
+	}
 }
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mca3/pikonode/api"
+	"github.com/mca3/pikonode/internal/config"
+	"github.com/mca3/pikonode/internal/control"
+	"github.com/mca3/pikonode/net/wg/wgtest"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func mustKey(t *testing.T) wgtypes.Key {
+	t.Helper()
+
+	k, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k.PublicKey()
+}
+
+// newTestInstance creates an instance with a fake WireGuard device, and clears
+// the global state touched by the reconciler.
+func newTestInstance(t *testing.T) (*instance, *wgtest.Device) {
+	seenPeers = map[string]discovPeer{}
+	t.Cleanup(func() {
+		seenPeers = map[string]discovPeer{}
+	})
+
+	dev := wgtest.New("pn0")
+
+	in := newInstance("test", &config.File{Config: config.Default()})
+	in.wgDev = dev
+	return in, dev
+}
+
+func reconcile(t *testing.T, in *instance, dev *wgtest.Device, peers []api.Device) {
+	t.Helper()
+
+	dev.ResetChanges()
+	if err := in.wgReconcile(in.wgDesiredPeers(peers)); err != nil {
+		t.Fatalf("wgReconcile = %v", err)
+	}
+}
+
+func assertChanges(t *testing.T, dev *wgtest.Device, adds, removes int) {
+	t.Helper()
+
+	if a, r := dev.Changes(); a != adds || r != removes {
+		t.Errorf("changes = %d adds, %d removes; expected %d adds, %d removes", a, r, adds, removes)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	in, dev := newTestInstance(t)
+	ka, kb, kc := mustKey(t), mustKey(t), mustKey(t)
+
+	peers := []api.Device{
+		{ID: 1, PublicKey: ka.String(), IP: "fd00::1", Endpoint: "192.0.2.1:1000"},
+		{ID: 2, PublicKey: kb.String(), IP: "fd00::2", Endpoint: "192.0.2.2:1000"},
+	}
+
+	reconcile(t, in, dev, peers)
+	assertChanges(t, dev, 2, 0)
+	dev.AssertPeer(t, ka, "fd00::1", "192.0.2.1:1000")
+	dev.AssertPeer(t, kb, "fd00::2", "192.0.2.2:1000")
+
+	// Nothing changed, so nothing should happen.
+	reconcile(t, in, dev, peers)
+	assertChanges(t, dev, 0, 0)
+
+	// Peer moves and gets a new IP.
+	peers[0].IP = "fd00::11"
+	peers[0].Endpoint = "192.0.2.11:1000"
+
+	reconcile(t, in, dev, peers)
+	assertChanges(t, dev, 1, 0)
+	dev.AssertPeer(t, ka, "fd00::11", "192.0.2.11:1000")
+	dev.Iface().AssertNoRoute(t, "fd00::1")
+
+	// Peer rekeys.
+	peers[1].PublicKey = kc.String()
+
+	reconcile(t, in, dev, peers)
+	assertChanges(t, dev, 1, 1)
+	dev.AssertNoPeer(t, kb)
+	dev.AssertPeer(t, kc, "fd00::2", "192.0.2.2:1000")
+	dev.Iface().AssertRoute(t, "fd00::2")
+
+	// Peer leaves.
+	reconcile(t, in, dev, peers[:1])
+	assertChanges(t, dev, 0, 1)
+	dev.AssertNoPeer(t, kc)
+	dev.Iface().AssertNoRoute(t, "fd00::2")
+
+	if _, ok := in.wgEndpoints[kc]; ok {
+		t.Errorf("endpoint of removed peer is still recorded")
+	}
+}
+
+func TestReconcileDiscovery(t *testing.T) {
+	in, dev := newTestInstance(t)
+	ka := mustKey(t)
+
+	peers := []api.Device{
+		{ID: 1, PublicKey: ka.String(), IP: "fd00::1", Endpoint: "192.0.2.1:1000"},
+	}
+
+	reconcile(t, in, dev, peers)
+	dev.AssertPeer(t, ka, "fd00::1", "192.0.2.1:1000")
+
+	// They said hello on the local network.
+	seenPeers[ka.String()] = discovPeer{LastSeen: time.Now(), Endpoint: "10.0.0.5:1000"}
+
+	reconcile(t, in, dev, peers)
+	assertChanges(t, dev, 1, 0)
+	dev.AssertPeer(t, ka, "fd00::1", "10.0.0.5:1000")
+
+	if src := in.wgEndpoints[ka].Source; src != control.SourceLAN {
+		t.Errorf("source = %s, expected %s", src, control.SourceLAN)
+	}
+
+	// They haven't said hello in a while.
+	seenPeers[ka.String()] = discovPeer{LastSeen: time.Now().Add(-discovGracePeriod * 2), Endpoint: "10.0.0.5:1000"}
+
+	reconcile(t, in, dev, peers)
+	assertChanges(t, dev, 1, 0)
+	dev.AssertPeer(t, ka, "fd00::1", "192.0.2.1:1000")
+}
+
+func TestReconcileKeepsPunch(t *testing.T) {
+	in, dev := newTestInstance(t)
+	kp := mustKey(t)
+
+	in.wgPunchPeer = &wgPeer{
+		Key:      kp,
+		IP:       mustParseIPNet("fd00::ffff"),
+		Endpoint: mustParseUDPAddr("192.0.2.100:8743"),
+		Source:   control.SourcePikopunch,
+	}
+	if err := in.wgAddPeer(*in.wgPunchPeer); err != nil {
+		t.Fatal(err)
+	}
+
+	reconcile(t, in, dev, nil)
+	assertChanges(t, dev, 0, 0)
+	dev.AssertPeer(t, kp, "fd00::ffff", "192.0.2.100:8743")
+}
@@ -1,89 +1,364 @@
 package config
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"reflect"
+	"runtime"
 )
 
 var ConfigFileOverride = ""
 
-var Cfg = struct {
-	Rendezvous    string
-	Token         string
+// Version is the version of the config file format that this package writes.
+// Older files are migrated when they are read; see migrate.go.
+const Version = 1
+
+// fileMode is the mode of config files, which hold secrets.
+const fileMode = 0o600
+
+// Config is the contents of a config file.
+type Config struct {
+	// Version is the version of the format that the file was written in.
+	Version int
+
+	Rendezvous string
+	Token      string
+
+	// Username and Password are used to log in again when the token
+	// expires.
+	// Both are optional; see also LoginPassword.
+	Username string
+	Password string
+
 	DeviceID      int64
 	PrivateKey    string
 	PublicKey     string
 	InterfaceName string
 	ListenPort    int
-}{
-	Rendezvous: "http://localhost:8080/api",
-	Token:      "",
-	DeviceID:   0,
 
-	InterfaceName: "pn0",
-	ListenPort:    0,
+	// Backend is the WireGuard implementation to use: "kernel",
+	// "userspace" or "auto".
+	Backend string
+
+	// DNSSuffix is the domain that peers are named under, e.g.
+	// "laptop.pn.local".
+	DNSSuffix string
+
+	// DNSFallback is the address of the DNS server that queries for other
+	// names are forwarded to.
+	// If empty, they are refused.
+	// Like Instances, it is only read from the config file that pikonoded
+	// was started with.
+	DNSFallback string
+
+	// DNSNegativeTTL is how many seconds resolvers may remember that a
+	// name does not exist for, so that new devices become resolvable
+	// quickly.
+	// If 0, the absence of a name is remembered as long as a name is.
+	// Like DNSFallback, it is only read from the config file that
+	// pikonoded was started with.
+	DNSNegativeTTL int
+
+	// Discovery enables finding peers on the local network, so that they
+	// may be reached directly.
+	Discovery bool
+
+	// Instances names other profiles that pikonoded brings up alongside
+	// this one, each with an interface of its own.
+	// It is only read from the config file that pikonoded was started
+	// with.
+	Instances []string `json:",omitempty"`
+}
+
+// Default returns the config used when there is no config file.
+func Default() Config {
+	return Config{
+		Version: Version,
+
+		Rendezvous: "http://localhost:8080/api",
+
+		InterfaceName: "pn0",
+		Backend:       "auto",
+		DNSSuffix:     "pn.local",
+		DNSFallback:   "1.1.1.1:53",
+		Discovery:     true,
+	}
+}
+
+// Cfg is the config in use.
+var Cfg = Default()
+
+// PasswordEnv is the environment variable that, when set, overrides
+// Cfg.Password.
+const PasswordEnv = "PIKONODE_PASSWORD"
+
+// LoginPassword returns the password used to log in again when the token
+// expires.
+func LoginPassword() string {
+	if pw := os.Getenv(PasswordEnv); pw != "" {
+		return pw
+	}
+	return Cfg.Password
+}
 
-	PrivateKey: "",
-	PublicKey:  "",
+// Login returns the username and password used to log in again when the
+// token expires. ok is false if either is missing.
+func (c Config) Login() (username, password string, ok bool) {
+	return c.Username, c.Password, c.Username != "" && c.Password != ""
 }
 
-func resolveConfigFile() string {
+// Path returns the path of the config file in use: ConfigFileOverride or
+// $PIKONODE_CONFIG if set, or else that of the current profile.
+func Path() (string, error) {
 	if ConfigFileOverride != "" {
-		return ConfigFileOverride
+		return ConfigFileOverride, nil
+	} else if path := os.Getenv(ConfigEnv); path != "" {
+		return path, nil
 	}
 
-	Cfg, err := os.UserConfigDir()
+	return ProfilePath(CurrentProfile())
+}
+
+// ReadFile reads, migrates and validates a config file.
+//
+// migrated is set if the file was written in an older version of the format,
+// in which case it should be written back with WriteFile.
+func ReadFile(path string) (c Config, migrated bool, err error) {
+	c, migrated, err = readFile(path)
 	if err != nil {
-		Cfg, err = os.Getwd()
-		if err != nil {
-			panic(err)
-		}
+		return c, false, err
+	} else if err := c.Validate(); err != nil {
+		return c, false, fmt.Errorf("%s: %w", path, err)
 	}
 
-	return filepath.Join(Cfg, "pikonode", "config.json")
+	return c, migrated, nil
 }
 
-func SaveConfigFile() error {
-	path := resolveConfigFile()
+// readFile reads and migrates a config file without validating it, for when
+// more is applied over it before it is used.
+func readFile(path string) (c Config, migrated bool, err error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return c, false, err
+	}
 
-	base := filepath.Dir(path)
-	if err := os.MkdirAll(base, 0o777); err != nil {
-		return fmt.Errorf("failed to create config directory: %v", err)
+	c, migrated, err = parse(buf)
+	if err != nil {
+		return c, false, fmt.Errorf("%s: %w", path, err)
 	}
 
-	f, err := os.Create(path)
+	return c, migrated, nil
+}
+
+// parse decodes a config file, migrating it to the current version first.
+func parse(buf []byte) (Config, bool, error) {
+	c := Default()
+
+	raw := map[string]any{}
+	if err := json.Unmarshal(buf, &raw); err != nil {
+		return c, false, fmt.Errorf("invalid JSON: %w", err)
+	}
+
+	migrated, err := migrate(raw)
+	if err != nil {
+		return c, false, err
+	}
+
+	buf, err = json.Marshal(raw)
 	if err != nil {
+		return c, false, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&c); err != nil {
+		return c, false, decodeError(err)
+	}
+
+	return c, migrated, nil
+}
+
+// WriteFile validates c and atomically replaces the config file at path with
+// it.
+//
+// The file is only readable by its owner, as it holds the private key and
+// token.
+func WriteFile(path string, c Config) error {
+	if err := c.Validate(); err != nil {
 		return err
 	}
-	defer f.Close()
 
-	return json.NewEncoder(f).Encode(&Cfg)
+	c.Version = Version
+
+	buf, err := json.MarshalIndent(&c, "", "\t")
+	if err != nil {
+		return err
+	}
+	buf = append(buf, '\n')
+
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create config directory: %w", err)
+	}
+
+	f, err := os.CreateTemp(dir, "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := f.Chmod(fileMode); err != nil && runtime.GOOS != "windows" {
+		f.Close()
+		return err
+	}
+
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
 }
 
-func ReadConfigFile() error {
-	path := resolveConfigFile()
+// File is a config file that was loaded with Open.
+type File struct {
+	Path string
 
-	_, err := os.Stat(path)
-	if errors.Is(err, fs.ErrNotExist) {
-		err := SaveConfigFile()
+	// Config is the config in effect, including drop-ins and environment
+	// variables.
+	// Changes to it are written to the file by Save.
+	Config Config
+
+	// file and loaded are the contents of the file and Config as it was
+	// when it was loaded, which Save uses to find what changed.
+	file, loaded Config
+}
+
+// Open loads the config file at path as Load does, writing it back if it was
+// migrated.
+func Open(path string) (*File, error) {
+	c, file, migrated, err := Load(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if migrated {
+		if err := WriteFile(path, file); err != nil {
+			return nil, err
+		}
+	}
+
+	return &File{Path: path, Config: c, file: file, loaded: c}, nil
+}
+
+// Save writes the changes made to f.Config back to the config file.
+//
+// Values that came from drop-ins or the environment are only written if they
+// were changed.
+func (f *File) Save() error {
+	file := Merge(f.file, f.loaded, f.Config)
+	if err := WriteFile(f.Path, file); err != nil {
+		return err
+	}
+
+	f.file, f.loaded = file, f.Config
+	return nil
+}
+
+// SaveToken sets the token in f.Config and writes it to the config file.
+// It is meant for api.API.OnToken.
+func (f *File) SaveToken(token string) error {
+	f.Config.Token = token
+	return f.Save()
+}
+
+// Keep sets the named fields of Config back to their values in old, without
+// counting that as a change, so that Save leaves them alone in the file.
+//
+// This is for programs that cannot apply some fields until they restart.
+func (f *File) Keep(old Config, fields ...string) {
+	ov := reflect.ValueOf(old)
+	cv, lv := reflect.ValueOf(&f.Config).Elem(), reflect.ValueOf(&f.loaded).Elem()
+
+	for _, name := range fields {
+		cv.FieldByName(name).Set(ov.FieldByName(name))
+		lv.FieldByName(name).Set(ov.FieldByName(name))
+	}
+}
+
+// current is the file that Cfg was loaded from.
+var current = &File{Config: Default(), file: Default(), loaded: Default()}
+
+// Current returns the file that Cfg was loaded from by ReadConfigFile.
+func Current() *File {
+	return current
+}
+
+// SaveConfigFile writes changes made to Cfg back to the config file.
+func SaveConfigFile() error {
+	path, err := Path()
+	if err != nil {
 		return err
 	}
 
-	f, err := os.Open(path)
+	current.Path, current.Config = path, Cfg
+	return current.Save()
+}
+
+// SaveToken sets the token in Cfg and writes it to the config file, as
+// File.SaveToken does.
+func SaveToken(token string) error {
+	path, err := Path()
 	if err != nil {
 		return err
 	}
-	defer f.Close()
 
-	if err := json.NewDecoder(f).Decode(&Cfg); err != nil {
+	current.Path, current.Config = path, Cfg
+	err = current.SaveToken(token)
+	Cfg = current.Config
+	return err
+}
+
+// ReadConfigFile loads the config file into Cfg, creating it if it does not
+// exist.
+func ReadConfigFile() error {
+	path, err := Path()
+	if err != nil {
 		return err
 	}
 
-	// TODO: Sanity checks
+	st, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		if err := WriteFile(path, Default()); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	} else if runtime.GOOS != "windows" && st.Mode().Perm()&0o077 != 0 {
+		// Older versions created the file with the default
+		// permissions.
+		_ = os.Chmod(path, fileMode)
+	}
+
+	f, err := Open(path)
+	if err != nil {
+		return err
+	}
 
+	Cfg, current = f.Config, f
 	return nil
 }
@@ -0,0 +1,348 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+const (
+	testPrivateKey = "WAy55/Zsj8nRUfET3tjs6r3yNlNYKLyWVDfzUWIu1XA="
+	testPublicKey  = "T9/+TMzmfywCTbBXkPKrlwTYPdtUx9H8v7KXmoh6OjA="
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		edit  func(c *Config)
+		field string
+	}{
+		{"default", func(c *Config) {}, ""},
+		{"keys", func(c *Config) { c.PrivateKey, c.PublicKey = testPrivateKey, testPublicKey }, ""},
+		{"scheme", func(c *Config) { c.Rendezvous = "ftp://example.com" }, "Rendezvous"},
+		{"no host", func(c *Config) { c.Rendezvous = "https://" }, "Rendezvous"},
+		{"bad private key", func(c *Config) { c.PrivateKey = "hunter2" }, "PrivateKey"},
+		{"bad public key", func(c *Config) { c.PublicKey = "AAAA" }, "PublicKey"},
+		{"mismatched keys", func(c *Config) { c.PrivateKey, c.PublicKey = testPrivateKey, testPrivateKey }, "PublicKey"},
+		{"port", func(c *Config) { c.ListenPort = 65536 }, "ListenPort"},
+		{"empty interface", func(c *Config) { c.InterfaceName = "" }, "InterfaceName"},
+		{"long interface", func(c *Config) { c.InterfaceName = "pikonet-interface" }, "InterfaceName"},
+		{"slash interface", func(c *Config) { c.InterfaceName = "pn/0" }, "InterfaceName"},
+		{"backend", func(c *Config) { c.Backend = "wireguard-go" }, "Backend"},
+		{"uppercase suffix", func(c *Config) { c.DNSSuffix = "PN" }, "DNSSuffix"},
+		{"empty suffix label", func(c *Config) { c.DNSSuffix = "pn..local" }, "DNSSuffix"},
+		{"no fallback", func(c *Config) { c.DNSFallback = "" }, ""},
+		{"negative TTL", func(c *Config) { c.DNSNegativeTTL = -1 }, "DNSNegativeTTL"},
+		{"fallback without port", func(c *Config) { c.DNSFallback = "1.1.1.1" }, "DNSFallback"},
+		{"instances", func(c *Config) { c.Instances = []string{"work", "customer"} }, ""},
+		{"bad instance", func(c *Config) { c.Instances = []string{"../work"} }, "Instances"},
+		{"duplicate instance", func(c *Config) { c.Instances = []string{"work", "work"} }, "Instances"},
+	}
+
+	for _, v := range tests {
+		t.Run(v.name, func(t *testing.T) {
+			c := Default()
+			v.edit(&c)
+
+			err := c.Validate()
+			if v.field == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+
+			fe := &FieldError{}
+			if !errors.As(err, &fe) || fe.Field != v.field {
+				t.Fatalf("err = %v, expected an error for %s", err, v.field)
+			}
+		})
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+
+	// The format before versions existed.
+	old := `{"Rendezvous":"https://example.com/api","Token":"abc","DeviceID":3,"PrivateKey":"","PublicKey":"","InterfaceName":"pn0","ListenPort":1234,"Backend":""}`
+	if err := os.WriteFile(path, []byte(old), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	c, migrated, err := ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read config: %v", err)
+	} else if !migrated {
+		t.Errorf("old config was not migrated")
+	}
+
+	if c.Version != Version || c.Backend != "auto" || c.Token != "abc" || c.DeviceID != 3 || c.ListenPort != 1234 {
+		t.Errorf("got %+v after migration", c)
+	}
+
+	if err := WriteFile(path, c); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+
+	if _, migrated, err := ReadFile(path); err != nil || migrated {
+		t.Errorf("got migrated = %v and err = %v after writing, expected neither", migrated, err)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"Version": 1000}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := ReadFile(path); err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Errorf("err = %v for a newer version", err)
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		json  string
+		field string
+	}{
+		{"unknown field", `{"Rendezvuos": "https://example.com"}`, "Rendezvuos"},
+		{"wrong type", `{"ListenPort": "1234"}`, "ListenPort"},
+		{"invalid", `{"ListenPort": 99999}`, "ListenPort"},
+	}
+
+	for _, v := range tests {
+		t.Run(v.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.json")
+			if err := os.WriteFile(path, []byte(v.json), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			_, _, err := ReadFile(path)
+
+			fe := &FieldError{}
+			if !errors.As(err, &fe) || fe.Field != v.field {
+				t.Fatalf("err = %v, expected an error for %s", err, v.field)
+			} else if !strings.Contains(err.Error(), path) {
+				t.Errorf("err = %v does not mention the path", err)
+			}
+		})
+	}
+}
+
+func TestWriteFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pikonode", "config.json")
+
+	c := Default()
+	c.PrivateKey, c.PublicKey = testPrivateKey, testPublicKey
+	if err := WriteFile(path, c); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+
+	st, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	} else if runtime.GOOS != "windows" && st.Mode().Perm() != fileMode {
+		t.Errorf("config file has mode %v, expected %v", st.Mode().Perm(), os.FileMode(fileMode))
+	}
+
+	c.ListenPort = -1
+	if err := WriteFile(path, c); err == nil {
+		t.Errorf("wrote an invalid config")
+	}
+
+	ents, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	} else if len(ents) != 1 {
+		t.Errorf("got %d files in the config directory, expected 1", len(ents))
+	}
+
+	c.ListenPort = 0
+
+	got, _, err := ReadFile(path)
+	if err != nil || !reflect.DeepEqual(got, c) {
+		t.Errorf("got %+v and %v, expected %+v", got, err, c)
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	tests := map[string]string{
+		"Rendezvous":     "PIKONODE_RENDEZVOUS",
+		"DeviceID":       "PIKONODE_DEVICE_ID",
+		"PrivateKey":     "PIKONODE_PRIVATE_KEY",
+		"InterfaceName":  "PIKONODE_INTERFACE_NAME",
+		"DNSNegativeTTL": "PIKONODE_DNS_NEGATIVE_TTL",
+		"Password":       PasswordEnv,
+	}
+
+	for field, want := range tests {
+		if got := EnvName(field); got != want {
+			t.Errorf("EnvName(%q) = %q, expected %q", field, got, want)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+
+	c := Default()
+	c.Token = "abc"
+	if err := WriteFile(path, c); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Mkdir(dropInDir(path), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	dropIns := map[string]string{
+		"10-port.json":   `{"ListenPort": 1234, "InterfaceName": "pn1"}`,
+		"20-port.json":   `{"ListenPort": 4321}`,
+		"ignored.conf":   `{"ListenPort": 1}`,
+		".20-port.json~": `{"ListenPort": 2}`,
+	}
+	for k, v := range dropIns {
+		if err := os.WriteFile(filepath.Join(dropInDir(path), k), []byte(v), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Setenv(EnvName("InterfaceName"), "pn2")
+	t.Setenv(EnvName("DeviceID"), "7")
+	t.Setenv(EnvName("Instances"), "work, customer,")
+	t.Setenv(EnvName("Discovery"), "false")
+
+	got, file, _, err := Load(path)
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	} else if got.ListenPort != 4321 || got.InterfaceName != "pn2" || got.DeviceID != 7 || got.Token != "abc" || !reflect.DeepEqual(got.Instances, []string{"work", "customer"}) || got.Discovery {
+		t.Errorf("got %+v", got)
+	} else if !reflect.DeepEqual(file, c) {
+		t.Errorf("file = %+v, expected %+v", file, c)
+	}
+
+	// Only the token was changed, so that is all that should be saved.
+	changed := got
+	changed.Token = "def"
+
+	want := c
+	want.Token = "def"
+	if m := Merge(file, got, changed); !reflect.DeepEqual(m, want) {
+		t.Errorf("Merge = %+v, expected %+v", m, want)
+	}
+
+	t.Setenv(EnvName("ListenPort"), "many")
+	if _, _, _, err := Load(path); err == nil || !strings.Contains(err.Error(), "PIKONODE_LISTEN_PORT") {
+		t.Errorf("err = %v for a bad environment variable", err)
+	}
+}
+
+func TestLoadInvalidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{"Version": 1, "InterfaceName": ""}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, _, err := Load(path); err == nil || !strings.Contains(err.Error(), "InterfaceName") {
+		t.Errorf("err = %v for an empty interface name", err)
+	}
+
+	// The environment is applied before validating.
+	t.Setenv(EnvName("InterfaceName"), "pn1")
+	if got, _, _, err := Load(path); err != nil {
+		t.Errorf("failed to load config fixed by the environment: %v", err)
+	} else if got.InterfaceName != "pn1" {
+		t.Errorf("InterfaceName = %q, expected pn1", got.InterfaceName)
+	}
+}
+
+func TestKeep(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+
+	c := Default()
+	c.InterfaceName = "pn1"
+	if err := WriteFile(path, c); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The interface is still pn0 until we restart, but the file should
+	// keep saying pn1.
+	f.Keep(Default(), "InterfaceName")
+	f.Config.Token = "abc"
+	if f.Config.InterfaceName != "pn0" {
+		t.Errorf("InterfaceName = %q, expected pn0", f.Config.InterfaceName)
+	}
+
+	if err := f.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, _, _, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	} else if got.InterfaceName != "pn1" || got.Token != "abc" {
+		t.Errorf("saved %+v, expected interface pn1 and token abc", got)
+	}
+}
+
+func TestSaveToken(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+
+	c := Default()
+	c.Username = "alice"
+	if err := WriteFile(path, c); err != nil {
+		t.Fatal(err)
+	}
+
+	// Passwords from the environment are used, but never written out.
+	t.Setenv(PasswordEnv, "hunter2")
+
+	f, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if user, pw, ok := f.Config.Login(); !ok || user != "alice" || pw != "hunter2" {
+		t.Errorf("Login = %q, %q, %v", user, pw, ok)
+	}
+
+	if err := f.SaveToken("abc"); err != nil {
+		t.Fatal(err)
+	}
+
+	got, _, err := ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	} else if got.Token != "abc" || got.Password != "" {
+		t.Errorf("saved %+v, expected token abc and no password", got)
+	}
+
+	if _, _, ok := Default().Login(); ok {
+		t.Errorf("got credentials without a username or password")
+	}
+}
+
+func TestProfilePath(t *testing.T) {
+	for _, v := range []string{"../work", "a/b", `a\b`, ".hidden"} {
+		if _, err := ProfilePath(v); err == nil {
+			t.Errorf("ProfilePath(%q) did not fail", v)
+		}
+	}
+
+	def, err := ProfilePath(DefaultProfile)
+	if err != nil || filepath.Base(def) != "config.json" {
+		t.Errorf("ProfilePath(%q) = %q, %v", DefaultProfile, def, err)
+	}
+
+	work, err := ProfilePath("work")
+	if err != nil || work != filepath.Join(filepath.Dir(def), "profiles", "work.json") {
+		t.Errorf("ProfilePath(%q) = %q, %v", "work", work, err)
+	}
+}
@@ -0,0 +1,168 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// envPrefix starts the names of environment variables that override fields.
+const envPrefix = "PIKONODE_"
+
+// EnvName returns the environment variable that overrides a field, e.g.
+// PIKONODE_DEVICE_ID for DeviceID.
+func EnvName(field string) string {
+	sb := &strings.Builder{}
+	sb.WriteString(envPrefix)
+
+	r := []rune(field)
+	for i, c := range r {
+		// Split before the start of a word: "DeviceID" is DEVICE_ID.
+		if i > 0 && unicode.IsUpper(c) && (unicode.IsLower(r[i-1]) || (i+1 < len(r) && unicode.IsLower(r[i+1]))) {
+			sb.WriteByte('_')
+		}
+		sb.WriteRune(unicode.ToUpper(c))
+	}
+
+	return sb.String()
+}
+
+// Load reads the config file at path, then applies its drop-ins and any
+// environment variables over it.
+//
+// file holds the contents of path alone, which is what should be written back
+// to it; see Merge.
+// migrated is set if path was written in an older version of the format.
+// Only the merged config is validated, so that an override may fix the file.
+func Load(path string) (c, file Config, migrated bool, err error) {
+	file, migrated, err = readFile(path)
+	if err != nil {
+		return c, file, false, err
+	}
+
+	c = file
+
+	if err := applyDropIns(&c, dropInDir(path)); err != nil {
+		return c, file, false, err
+	}
+
+	if err := applyEnv(&c); err != nil {
+		return c, file, false, err
+	}
+
+	return c, file, migrated, c.Validate()
+}
+
+// applyDropIns decodes each JSON file in dir over c in lexical order, so that
+// they may override any field.
+func applyDropIns(c *Config, dir string) error {
+	ents, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	names := []string{}
+	for _, v := range ents {
+		if !v.IsDir() && filepath.Ext(v.Name()) == ".json" && !strings.HasPrefix(v.Name(), ".") {
+			names = append(names, v.Name())
+		}
+	}
+	sort.Strings(names)
+
+	for _, v := range names {
+		path := filepath.Join(dir, v)
+
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		dec := json.NewDecoder(bytes.NewReader(buf))
+		dec.DisallowUnknownFields()
+
+		version := c.Version
+		if err := dec.Decode(c); err != nil {
+			return fmt.Errorf("%s: %w", path, decodeError(err))
+		} else if c.Version != version {
+			return fmt.Errorf("%s: %w", path, &FieldError{"Version", "cannot be set in a drop-in"})
+		}
+	}
+
+	return nil
+}
+
+// applyEnv overrides the fields of c with environment variables named by
+// EnvName.
+func applyEnv(c *Config) error {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Name
+		if name == "Version" {
+			continue
+		}
+
+		env := EnvName(name)
+		val, ok := os.LookupEnv(env)
+		if !ok {
+			continue
+		}
+
+		f := v.Field(i)
+		switch f.Kind() {
+		case reflect.String:
+			f.SetString(val)
+		case reflect.Int, reflect.Int64:
+			n, err := strconv.ParseInt(val, 10, 64)
+			if err != nil {
+				return &FieldError{name, fmt.Sprintf("$%s is not a number", env)}
+			}
+			f.SetInt(n)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return &FieldError{name, fmt.Sprintf("$%s is not true or false", env)}
+			}
+			f.SetBool(b)
+		case reflect.Slice:
+			// Lists are separated by commas.
+			list := []string{}
+			for _, v := range strings.Split(val, ",") {
+				if v = strings.TrimSpace(v); v != "" {
+					list = append(list, v)
+				}
+			}
+			f.Set(reflect.ValueOf(list))
+		}
+	}
+
+	return nil
+}
+
+// Merge applies the fields that changed between old and new to file, so that
+// values that came from drop-ins or the environment are not written to the
+// config file unless they were changed.
+func Merge(file, old, new Config) Config {
+	fv := reflect.ValueOf(&file).Elem()
+	ov, nv := reflect.ValueOf(old), reflect.ValueOf(new)
+
+	for i := 0; i < fv.NumField(); i++ {
+		if !reflect.DeepEqual(ov.Field(i).Interface(), nv.Field(i).Interface()) {
+			fv.Field(i).Set(nv.Field(i))
+		}
+	}
+
+	return file
+}
@@ -0,0 +1,40 @@
+package config
+
+import "fmt"
+
+// migrations upgrade the raw contents of a config file.
+// migrations[i] upgrades a file from version i to version i+1.
+var migrations = []func(raw map[string]any){
+	// Version 0 files have no Version field, and may have an empty
+	// Backend from before it had a default.
+	func(raw map[string]any) {
+		if b, _ := raw["Backend"].(string); b == "" {
+			raw["Backend"] = "auto"
+		}
+	},
+}
+
+// migrate upgrades the raw contents of a config file to the current version,
+// returning whether anything was done.
+func migrate(raw map[string]any) (bool, error) {
+	v := 0
+	if rv, ok := raw["Version"]; ok {
+		f, ok := rv.(float64)
+		if !ok || f != float64(int(f)) || f < 0 {
+			return false, &FieldError{"Version", fmt.Sprintf("%v is not a valid version", rv)}
+		}
+		v = int(f)
+	}
+
+	if v > Version {
+		return false, &FieldError{"Version", fmt.Sprintf("version %d is newer than this program supports (%d)", v, Version)}
+	}
+
+	for ; v < Version; v++ {
+		migrations[v](raw)
+	}
+
+	migrated := raw["Version"] != float64(Version)
+	raw["Version"] = Version
+	return migrated, nil
+}
@@ -0,0 +1,134 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// Environment variables that choose the config file.
+const (
+	ConfigEnv  = "PIKONODE_CONFIG"
+	ProfileEnv = "PIKONODE_PROFILE"
+)
+
+// DefaultProfile is the name of the profile stored in config.json.
+const DefaultProfile = "default"
+
+// Profile is the name of the profile to use.
+// If empty, $PIKONODE_PROFILE is used, or else DefaultProfile.
+//
+// ConfigFileOverride takes precedence over Profile.
+var Profile = ""
+
+// SystemConfigDir is where the system-wide config lives, which is used by
+// pikonoded when it runs as a service.
+var SystemConfigDir = systemConfigDir()
+
+func systemConfigDir() string {
+	if runtime.GOOS == "windows" {
+		if dir := os.Getenv("ProgramData"); dir != "" {
+			return filepath.Join(dir, "pikonode")
+		}
+		return `C:\ProgramData\pikonode`
+	}
+	return "/etc/pikonode"
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func readable(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	f.Close()
+	return true
+}
+
+// Dir returns the directory that holds config files.
+//
+// The user's config directory is used if it has a config file in it.
+// Otherwise, SystemConfigDir is used if it has one that we can read, or if we
+// are running as root or have no config directory of our own.
+func Dir() string {
+	user, err := os.UserConfigDir()
+	if err == nil {
+		user = filepath.Join(user, "pikonode")
+		if exists(filepath.Join(user, "config.json")) {
+			return user
+		}
+	}
+
+	if err != nil || os.Geteuid() == 0 || readable(filepath.Join(SystemConfigDir, "config.json")) {
+		return SystemConfigDir
+	}
+	return user
+}
+
+// CurrentProfile returns the name of the profile in use.
+func CurrentProfile() string {
+	if Profile != "" {
+		return Profile
+	} else if p := os.Getenv(ProfileEnv); p != "" {
+		return p
+	}
+	return DefaultProfile
+}
+
+// ProfilePath returns the path of the config file for a profile.
+func ProfilePath(name string) (string, error) {
+	if name == "" || name == DefaultProfile {
+		return filepath.Join(Dir(), "config.json"), nil
+	}
+
+	if !validProfile(name) {
+		return "", fmt.Errorf("invalid profile name %q", name)
+	}
+
+	return filepath.Join(Dir(), "profiles", name+".json"), nil
+}
+
+// validProfile determines if name may be used as the name of a profile.
+func validProfile(name string) bool {
+	return name != "" && !strings.ContainsAny(name, `/\`) && !strings.HasPrefix(name, ".")
+}
+
+// Profiles lists the profiles that have config files.
+func Profiles() ([]string, error) {
+	profiles := []string{}
+	if exists(filepath.Join(Dir(), "config.json")) {
+		profiles = append(profiles, DefaultProfile)
+	}
+
+	ents, err := os.ReadDir(filepath.Join(Dir(), "profiles"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return profiles, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, v := range ents {
+		if name, ok := strings.CutSuffix(v.Name(), ".json"); ok && !v.IsDir() && !strings.HasPrefix(name, ".") {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+	return append(profiles, names...), nil
+}
+
+// dropInDir returns the directory holding files that override parts of the
+// config file at path; for config.json, this is config.d.
+func dropInDir(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + ".d"
+}
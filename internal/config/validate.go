@@ -0,0 +1,146 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// FieldError describes a field of the config that is invalid.
+type FieldError struct {
+	Field  string
+	Reason string
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Reason)
+}
+
+// maxInterfaceName is the longest interface name that Linux allows.
+const maxInterfaceName = 15
+
+// maxTTL is the longest that DNS answers may be cached for: a day.
+const maxTTL = 86400
+
+// Validate checks every field of c, returning a *FieldError for each that is
+// invalid.
+func (c *Config) Validate() error {
+	errs := []error{}
+	bad := func(field, f string, d ...any) {
+		errs = append(errs, &FieldError{field, fmt.Sprintf(f, d...)})
+	}
+
+	if u, err := url.Parse(c.Rendezvous); err != nil {
+		bad("Rendezvous", "invalid URL: %v", err)
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		bad("Rendezvous", "URL %q must start with http:// or https://", c.Rendezvous)
+	} else if u.Host == "" {
+		bad("Rendezvous", "URL %q has no host", c.Rendezvous)
+	}
+
+	if c.DeviceID < 0 {
+		bad("DeviceID", "must not be negative")
+	}
+
+	priv, privErr := wgtypes.ParseKey(c.PrivateKey)
+	if c.PrivateKey != "" && privErr != nil {
+		bad("PrivateKey", "not a valid WireGuard key")
+	}
+
+	pub, pubErr := wgtypes.ParseKey(c.PublicKey)
+	if c.PublicKey != "" && pubErr != nil {
+		bad("PublicKey", "not a valid WireGuard key")
+	}
+
+	if c.PrivateKey != "" && c.PublicKey != "" && privErr == nil && pubErr == nil && priv.PublicKey() != pub {
+		bad("PublicKey", "does not belong to PrivateKey")
+	}
+
+	switch name := c.InterfaceName; {
+	case name == "":
+		bad("InterfaceName", "must not be empty")
+	case len(name) > maxInterfaceName:
+		bad("InterfaceName", "%q is longer than %d characters", name, maxInterfaceName)
+	case name == "." || name == ".." || strings.ContainsAny(name, "/: \t\n"):
+		bad("InterfaceName", "%q is not a valid interface name", name)
+	}
+
+	if c.ListenPort < 0 || c.ListenPort > 65535 {
+		bad("ListenPort", "%d is not between 0 and 65535", c.ListenPort)
+	}
+
+	switch c.Backend {
+	case "kernel", "userspace", "auto":
+	default:
+		bad("Backend", "%q is not one of kernel, userspace or auto", c.Backend)
+	}
+
+	if err := validDomain(c.DNSSuffix); err != nil {
+		bad("DNSSuffix", "%v", err)
+	}
+
+	if c.DNSFallback != "" {
+		if _, port, err := net.SplitHostPort(c.DNSFallback); err != nil || port == "" {
+			bad("DNSFallback", "%q is not an address with a port, such as 1.1.1.1:53", c.DNSFallback)
+		}
+	}
+
+	if c.DNSNegativeTTL < 0 || c.DNSNegativeTTL > maxTTL {
+		bad("DNSNegativeTTL", "%d is not between 0 and %d", c.DNSNegativeTTL, maxTTL)
+	}
+
+	seen := map[string]bool{}
+	for _, v := range c.Instances {
+		if !validProfile(v) {
+			bad("Instances", "%q is not a valid profile name", v)
+		} else if seen[v] {
+			bad("Instances", "%q is listed more than once", v)
+		}
+		seen[v] = true
+	}
+
+	return errors.Join(errs...)
+}
+
+// validDomain checks that name is a lowercase domain name, as domains are
+// matched case insensitively.
+func validDomain(name string) error {
+	if name == "" {
+		return errors.New("must not be empty")
+	}
+
+	for _, l := range strings.Split(name, ".") {
+		if l == "" || len(l) > 63 || l[0] == '-' || l[len(l)-1] == '-' {
+			return fmt.Errorf("%q is not a valid domain name", name)
+		}
+
+		for _, r := range l {
+			if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' {
+				return fmt.Errorf("%q is not a lowercase domain name", name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// decodeError makes errors from decoding a config file point at the field
+// that is wrong.
+func decodeError(err error) error {
+	var te *json.UnmarshalTypeError
+	if errors.As(err, &te) {
+		return &FieldError{te.Field, fmt.Sprintf("expected %s, got %s", te.Type, te.Value)}
+	}
+
+	// encoding/json doesn't have a type for this.
+	if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		return &FieldError{strings.Trim(field, `"`), "unknown field"}
+	}
+
+	return err
+}
@@ -0,0 +1,87 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Client talks to a running daemon over its control socket.
+//
+// A Client is safe for use by multiple goroutines, but calls are performed one
+// at a time.
+type Client struct {
+	conn net.Conn
+	dec  *json.Decoder
+	id   int64
+	mu   sync.Mutex
+}
+
+// Dial connects to the control socket at path.
+func Dial(ctx context.Context, path string) (*Client, error) {
+	d := net.Dialer{}
+
+	c, err := d.DialContext(ctx, "unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Responses are not limited in size like requests are, as
+	// the daemon is trusted; lists of peers can get long.
+	return &Client{conn: c, dec: json.NewDecoder(c)}, nil
+}
+
+// Call calls method on the daemon, storing the result in the value pointed to
+// by result.
+//
+// params may be nil if the method takes no parameters, and result may be nil
+// if the result is not wanted.
+func (c *Client) Call(ctx context.Context, method Method, params, result any) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.id++
+	req := Request{Version: Version, ID: c.id, Method: method}
+
+	if params != nil {
+		var err error
+		if req.Params, err = json.Marshal(params); err != nil {
+			return err
+		}
+	}
+
+	if dl, ok := ctx.Deadline(); ok {
+		c.conn.SetDeadline(dl)
+		defer c.conn.SetDeadline(time.Time{})
+	}
+
+	if err := json.NewEncoder(c.conn).Encode(&req); err != nil {
+		return err
+	}
+
+	resp := Response{}
+	if err := c.dec.Decode(&resp); errors.As(err, new(*json.SyntaxError)) || errors.As(err, new(*json.UnmarshalTypeError)) {
+		return fmt.Errorf("malformed response: %w", err)
+	} else if err != nil {
+		return err
+	} else if resp.ID != req.ID {
+		return fmt.Errorf("response id %d does not match request id %d", resp.ID, req.ID)
+	} else if resp.Error != "" {
+		return &Error{Method: method, Message: resp.Error}
+	}
+
+	if result == nil || resp.Result == nil {
+		return nil
+	}
+
+	return json.Unmarshal(resp.Result, result)
+}
+
+// Close closes the connection to the daemon.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
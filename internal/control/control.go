@@ -0,0 +1,192 @@
+// Package control implements the protocol spoken over the pikonoded control
+// socket.
+//
+// # Background
+//
+// Every running pikonoded creates a UNIX socket named "pikonet.<pid>" in the
+// runtime directory of the user running it.
+//
+// The protocol is line-delimited JSON.
+// A client writes a single Request object followed by a newline, and the
+// daemon answers with a single Response object followed by a newline.
+// Any number of requests may be sent on one connection, but they are always
+// answered in order.
+//
+// Every message carries the protocol version.
+// The daemon refuses to answer requests with a version it does not know.
+package control
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/mca3/pikonode/api"
+)
+
+// Version is the version of the control protocol.
+const Version = 1
+
+// SocketPrefix is the prefix of the name of every control socket.
+// The PID of the daemon is appended to it.
+const SocketPrefix = "pikonet."
+
+// Method is the name of a procedure that the daemon exposes.
+type Method string
+
+const (
+	// MethodInstances returns a []Status, one for each instance.
+	MethodInstances Method = "instances"
+
+	// MethodStatus returns a Status.
+	MethodStatus Method = "status"
+
+	// MethodPeers returns a []Peer.
+	MethodPeers Method = "peers"
+
+	// MethodNetworks returns a []api.Network.
+	MethodNetworks Method = "networks"
+
+	// MethodDiscovery returns a []DiscoveredPeer.
+	MethodDiscovery Method = "discovery"
+
+	// MethodDNS returns a []DNSRecord.
+	MethodDNS Method = "dns"
+
+	// MethodWireGuard returns a []WireGuardPeer.
+	MethodWireGuard Method = "wireguard"
+
+	// MethodReload re-reads the config files of every instance and
+	// returns a ReloadResult.
+	MethodReload Method = "reload"
+)
+
+// Source describes where the endpoint of a peer was learned from.
+type Source string
+
+const (
+	// SourceRendezvous is used for endpoints reported by the Rendezvous
+	// server.
+	SourceRendezvous Source = "rendezvous"
+
+	// SourcePikopunch is used for the Pikopunch server itself.
+	SourcePikopunch Source = "pikopunch"
+
+	// SourceLAN is used for endpoints learned through local discovery.
+	SourceLAN Source = "lan"
+)
+
+// Request is a single call to the daemon.
+type Request struct {
+	Version int             `json:"v"`
+	ID      int64           `json:"id"`
+	Method  Method          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+// Response is the answer to a single Request.
+//
+// Exactly one of Result and Error is set.
+type Response struct {
+	Version int             `json:"v"`
+	ID      int64           `json:"id"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   string          `json:"error,omitempty"`
+}
+
+// InstanceParams are the parameters of requests for the state of a single
+// instance: MethodStatus, MethodPeers, MethodNetworks, MethodDNS and
+// MethodWireGuard.
+//
+// The first instance that the daemon started is used if Instance is empty.
+type InstanceParams struct {
+	Instance string `json:"instance,omitempty"`
+}
+
+// Status holds general information about the daemon and one of its instances.
+type Status struct {
+	PID     int       `json:"pid"`
+	Started time.Time `json:"started"`
+
+	// Instance is the name of the profile that the instance was started
+	// from.
+	Instance string `json:"instance"`
+
+	Rendezvous string `json:"rendezvous"`
+	Interface  string `json:"interface"`
+	ListenPort int    `json:"listen_port"`
+
+	Device api.Device `json:"device"`
+
+	// Connected is true when the daemon is connected to the Rendezvous
+	// server.
+	Connected bool `json:"connected"`
+
+	Networks int `json:"networks"`
+	Peers    int `json:"peers"`
+}
+
+// ReloadResult lists the config fields that changed when the daemon re-read
+// its config files.
+//
+// If the daemon has more than one instance, fields are prefixed with the name
+// of the instance they belong to, e.g. "work: ListenPort".
+type ReloadResult struct {
+	// Applied holds the fields that were changed without restarting.
+	Applied []string `json:"applied"`
+
+	// Restart holds the fields that only take effect once the daemon is
+	// restarted.
+	Restart []string `json:"restart"`
+}
+
+// Peer holds information about one peer, as seen by the daemon.
+type Peer struct {
+	ID        int64  `json:"id"`
+	Name      string `json:"name"`
+	IP        string `json:"ip"`
+	PublicKey string `json:"key"`
+
+	// Endpoint is the endpoint that the daemon has configured for this
+	// peer, and Source is where it came from.
+	Endpoint string `json:"endpoint,omitempty"`
+	Source   Source `json:"source"`
+
+	LastHandshake time.Time `json:"last_handshake"`
+	RxBytes       int64     `json:"rx_bytes"`
+	TxBytes       int64     `json:"tx_bytes"`
+}
+
+// DiscoveredPeer is a peer that has sent a HELLO on the local network.
+type DiscoveredPeer struct {
+	PublicKey string    `json:"key"`
+	Endpoint  string    `json:"endpoint"`
+	LastSeen  time.Time `json:"last_seen"`
+	Valid     bool      `json:"valid"`
+}
+
+// DNSRecord is a single name that the daemon resolves.
+type DNSRecord struct {
+	Name string `json:"name"`
+	IP   string `json:"ip"`
+}
+
+// WireGuardPeer holds the state of one peer as reported by WireGuard.
+type WireGuardPeer struct {
+	PublicKey     string    `json:"key"`
+	Endpoint      string    `json:"endpoint,omitempty"`
+	AllowedIPs    []string  `json:"allowed_ips"`
+	LastHandshake time.Time `json:"last_handshake"`
+	RxBytes       int64     `json:"rx_bytes"`
+	TxBytes       int64     `json:"tx_bytes"`
+}
+
+// Error is an error returned by the daemon.
+type Error struct {
+	Method  Method
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Method, e.Message)
+}
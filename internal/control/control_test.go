@@ -0,0 +1,136 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCall(t *testing.T) {
+	path := filepath.Join(t.TempDir(), SocketPrefix+"1")
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer l.Close()
+
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		ServeConn(c, func(m Method, params json.RawMessage) (any, error) {
+			if m != MethodStatus {
+				return nil, errors.New("nope")
+			}
+			return Status{PID: 1234}, nil
+		})
+	}()
+
+	c, err := Dial(context.Background(), path)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer c.Close()
+
+	st := Status{}
+	if err := c.Call(context.Background(), MethodStatus, nil, &st); err != nil {
+		t.Fatalf("Call(status) = %v", err)
+	} else if st.PID != 1234 {
+		t.Errorf("Status.PID = %d, expected 1234", st.PID)
+	}
+
+	var cerr *Error
+	err = c.Call(context.Background(), MethodPeers, nil, nil)
+	if !errors.As(err, &cerr) || cerr.Message != "nope" {
+		t.Errorf("Call(peers) = %v, expected nope", err)
+	}
+}
+
+func TestLargeResponse(t *testing.T) {
+	path := filepath.Join(t.TempDir(), SocketPrefix+"1")
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer l.Close()
+
+	// Far more than a request may be.
+	peers := make([]string, 50000)
+	for i := range peers {
+		peers[i] = "peer"
+	}
+
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		ServeConn(c, func(m Method, params json.RawMessage) (any, error) {
+			return peers, nil
+		})
+	}()
+
+	c, err := Dial(context.Background(), path)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer c.Close()
+
+	got := []string{}
+	if err := c.Call(context.Background(), MethodPeers, nil, &got); err != nil {
+		t.Fatalf("Call(peers) = %v", err)
+	} else if len(got) != len(peers) {
+		t.Errorf("got %d peers, expected %d", len(got), len(peers))
+	}
+}
+
+func TestVersionMismatch(t *testing.T) {
+	resp := handleRequest([]byte(`{"v":99,"id":5,"method":"status"}`), func(Method, json.RawMessage) (any, error) {
+		t.Fatal("handler called")
+		return nil, nil
+	})
+
+	if resp.ID != 5 || resp.Error == "" {
+		t.Errorf("handleRequest = %+v, expected an error", resp)
+	}
+}
+
+func TestFindSockets(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, pid := range []int{20, 3} {
+		l, err := net.Listen("unix", SocketPath(dir, pid))
+		if err != nil {
+			t.Fatalf("failed to listen: %v", err)
+		}
+		defer l.Close()
+	}
+
+	// Neither of these are control sockets.
+	os.WriteFile(filepath.Join(dir, SocketPrefix+"7"), nil, 0o600)
+	l, err := net.Listen("unix", filepath.Join(dir, "other.sock"))
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer l.Close()
+
+	socks, err := FindSockets(dir)
+	if err != nil {
+		t.Fatalf("FindSockets = %v", err)
+	}
+
+	exp := []string{SocketPath(dir, 3), SocketPath(dir, 20)}
+	if !reflect.DeepEqual(socks, exp) {
+		t.Errorf("FindSockets = %v, expected %v", socks, exp)
+	}
+}
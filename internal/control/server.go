@@ -0,0 +1,93 @@
+package control
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// maxRequestSize is the largest request that ServeConn will read.
+const maxRequestSize = 64 * 1024
+
+// Handler answers a single request.
+//
+// The value returned is encoded as the result of the request.
+// If error is non-nil, its message is sent to the client instead.
+type Handler func(method Method, params json.RawMessage) (any, error)
+
+// ServeConn answers requests on c until the client hangs up.
+//
+// c is closed when ServeConn returns.
+func ServeConn(c net.Conn, h Handler) error {
+	defer c.Close()
+
+	r := bufio.NewReaderSize(c, 4096)
+	enc := json.NewEncoder(c)
+
+	for {
+		line, err := readLine(r)
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		resp := handleRequest(line, h)
+		if err := enc.Encode(&resp); err != nil {
+			return err
+		}
+	}
+}
+
+// readLine reads a single request, refusing to read more than maxRequestSize
+// bytes.
+func readLine(r *bufio.Reader) ([]byte, error) {
+	var line []byte
+
+	for {
+		chunk, isPrefix, err := r.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+
+		line = append(line, chunk...)
+		if len(line) > maxRequestSize {
+			return nil, errors.New("request too large")
+		} else if !isPrefix {
+			return line, nil
+		}
+	}
+}
+
+// handleRequest decodes a request and calls the handler for it.
+func handleRequest(line []byte, h Handler) Response {
+	resp := Response{Version: Version}
+
+	req := Request{}
+	if err := json.Unmarshal(line, &req); err != nil {
+		resp.Error = fmt.Sprintf("malformed request: %v", err)
+		return resp
+	}
+
+	resp.ID = req.ID
+
+	if req.Version != Version {
+		resp.Error = fmt.Sprintf("unsupported protocol version %d", req.Version)
+		return resp
+	}
+
+	res, err := h(req.Method, req.Params)
+	if err != nil {
+		resp.Error = err.Error()
+		return resp
+	}
+
+	if resp.Result, err = json.Marshal(res); err != nil {
+		resp.Error = fmt.Sprintf("failed to encode result: %v", err)
+	}
+
+	return resp
+}
@@ -0,0 +1,69 @@
+package control
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// RuntimeDir returns the directory in which control sockets are created.
+//
+// This is XDG_RUNTIME_DIR, or the current working directory if it is unset.
+func RuntimeDir() (string, error) {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return dir, nil
+	}
+
+	return os.Getwd()
+}
+
+// SocketPath returns the path of the control socket for the daemon with the
+// specified PID.
+func SocketPath(dir string, pid int) string {
+	return filepath.Join(dir, fmt.Sprintf("%s%d", SocketPrefix, pid))
+}
+
+// FindSockets returns the paths of all control sockets in dir, ordered by the
+// PID of the daemon that owns them.
+//
+// Sockets left behind by daemons that have since exited are not filtered out;
+// callers should try each path in turn.
+func FindSockets(dir string) ([]string, error) {
+	ents, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	type sock struct {
+		path string
+		pid  int
+	}
+
+	socks := []sock{}
+	for _, v := range ents {
+		if v.Type()&os.ModeSocket == 0 || !strings.HasPrefix(v.Name(), SocketPrefix) {
+			continue
+		}
+
+		pid, err := strconv.Atoi(strings.TrimPrefix(v.Name(), SocketPrefix))
+		if err != nil {
+			continue
+		}
+
+		socks = append(socks, sock{filepath.Join(dir, v.Name()), pid})
+	}
+
+	sort.Slice(socks, func(i, j int) bool {
+		return socks[i].pid < socks[j].pid
+	})
+
+	paths := make([]string, len(socks))
+	for i, v := range socks {
+		paths[i] = v.path
+	}
+
+	return paths, nil
+}
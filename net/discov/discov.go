@@ -96,6 +96,18 @@ func (d *Discovery) Listen(ctx context.Context) error {
 	}
 	defer c.Close()
 
+	// Stop reading once ctx is done.
+	stop := make(chan struct{})
+	defer close(stop)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-stop:
+		}
+	}()
+
 	pc := ipv4.NewPacketConn(c)
 
 	d.mu.Lock()
@@ -124,7 +136,9 @@ func (d *Discovery) Listen(ctx context.Context) error {
 
 	for {
 		bytesRead, _, addr, err := pc.ReadFrom(buf)
-		if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		} else if err != nil {
 			return err
 		}
 
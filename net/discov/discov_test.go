@@ -76,11 +76,10 @@ func TestDiscov(t *testing.T) {
 	// We can't check for an error immediately either because there is no
 	// guarantee that a goroutine executes immediately, but it is
 	// guaranteed it will be executed "eventually."
-	errCh := make(chan error)
+	errCh := make(chan error, 1)
 	go func() {
 		errCh <- d.Listen(ctx)
 	}()
-	defer close(errCh)
 
 	// Wait for the signal
 	select {
@@ -101,4 +100,15 @@ func TestDiscov(t *testing.T) {
 	if !flag {
 		t.Fatal("timeout")
 	}
+	mu.Unlock()
+
+	// Listen stops once the context is done.
+	select {
+	case err := <-errCh:
+		if err != ctx.Err() {
+			t.Errorf("Listen = %v, expected %v", err, ctx.Err())
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Listen did not return after the context was done")
+	}
 }
@@ -5,6 +5,7 @@ package dns
 // It has not been optimized in any way, yet.
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -33,8 +34,17 @@ const (
 type dnsType uint16
 
 const (
-	typeA    dnsType = 1  // IPv4
-	typeAAAA dnsType = 28 // IPv6
+	typeA     dnsType = 1   // IPv4
+	typeNS    dnsType = 2   // Name server
+	typeCNAME dnsType = 5   // Canonical name
+	typeSOA   dnsType = 6   // Start of authority
+	typePTR   dnsType = 12  // Pointer to another name
+	typeMX    dnsType = 15  // Mail exchange
+	typeTXT   dnsType = 16  // Text
+	typeAAAA  dnsType = 28  // IPv6
+	typeSRV   dnsType = 33  // Service location
+	typeOPT   dnsType = 41  // EDNS0 options
+	typeAny   dnsType = 255 // Every record
 )
 
 type dnsClass uint16
@@ -67,6 +77,16 @@ type dnsRecord struct {
 	RData  []byte
 }
 
+// dnsEDNS holds the EDNS0 options of a message, which are sent as an OPT
+// pseudo-record in the additional section.
+type dnsEDNS struct {
+	UDPSize  uint16 // Largest UDP payload the sender can receive.
+	ExtRcode uint8  // Upper 8 bits of the response code.
+	Version  uint8
+	DO       bool   // DNSSEC OK. The sender wants DNSSEC records.
+	Options  []byte // Options, which are passed along untouched.
+}
+
 // dnsMessage holds a single DNS message and all related data.
 type dnsMessage struct {
 	ID     uint16 // ID of the message.
@@ -87,6 +107,10 @@ type dnsMessage struct {
 	Answers    []dnsRecord
 	Authority  []dnsRecord
 	Additional []dnsRecord
+
+	// EDNS holds the options from the OPT record, which is not in
+	// Additional. It is nil if the sender does not support EDNS0.
+	EDNS *dnsEDNS
 }
 
 // byteSliceAsString performs unsafe conversions from a byte slice to a string.
@@ -141,6 +165,51 @@ func parseLabels(msg, buf []byte, depth int) (labels []string, size int, err err
 	return labels, size, nil
 }
 
+// expandRData returns the record data of a record of type typ with the names
+// in it written out in full.
+//
+// Names may be compressed with pointers into msg, which would point at
+// something else entirely once the record is serialized into another message.
+// Only the types that predate RFC 3597 may be compressed, so the data of other
+// types is returned as is.
+func expandRData(msg, rdata []byte, typ dnsType) ([]byte, error) {
+	// The number of bytes before the first name, and the number of names.
+	prefix, names := 0, 1
+	switch typ {
+	case typeNS, typeCNAME, typePTR:
+	case typeMX:
+		prefix = 2
+	case typeSRV:
+		prefix = 6
+	case typeSOA:
+		names = 2
+	default:
+		return rdata, nil
+	}
+
+	if len(rdata) < prefix {
+		return nil, errors.New("rdata too short")
+	}
+
+	buf := &bytes.Buffer{}
+	buf.Write(rdata[:prefix])
+	rest := rdata[prefix:]
+
+	for i := 0; i < names; i++ {
+		labels, n, err := parseLabels(msg, rest, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		serializeLabels(buf, labels)
+		rest = rest[n:]
+	}
+
+	// The fixed fields that come after the names, such as those of SOA.
+	buf.Write(rest)
+	return buf.Bytes(), nil
+}
+
 // parseRecordSection attempts to parse a record section.
 func parseRecordSection(msg, section []byte, count int) (records []dnsRecord, size int, err error) {
 	read := 0
@@ -168,7 +237,10 @@ func parseRecordSection(msg, section []byte, count int) (records []dnsRecord, si
 			return records, read, fmt.Errorf("rdlength too long, %d > %d", rdlen, len(section)-9)
 		}
 
-		rdata := section[10 : 10+rdlen]
+		rdata, err := expandRData(msg, section[10:10+rdlen], typ)
+		if err != nil {
+			return records, read, fmt.Errorf("failed to parse rdata: %w", err)
+		}
 
 		records = append(records, dnsRecord{
 			Labels: labels,
@@ -250,10 +322,34 @@ func parseDNSMessage(buf []byte) (msg dnsMessage, err error) {
 	question = question[offs:]
 
 	// Additional...
-	msg.Additional, _, err = parseRecordSection(buf, question, int(msg.Arcount))
+	additional, _, err := parseRecordSection(buf, question, int(msg.Arcount))
 	if err != nil {
 		return msg, fmt.Errorf("failed parsing additional records: %w", err)
 	}
 
+	// ...which may hold the OPT record.
+	for _, v := range additional {
+		if v.Type != typeOPT {
+			msg.Additional = append(msg.Additional, v)
+			continue
+		}
+
+		if msg.EDNS != nil {
+			return msg, errors.New("more than one OPT record")
+		}
+		msg.EDNS = parseOPT(v)
+	}
+
 	return msg, nil
 }
+
+// parseOPT parses the fields of an OPT record.
+func parseOPT(r dnsRecord) *dnsEDNS {
+	return &dnsEDNS{
+		UDPSize:  uint16(r.Class),
+		ExtRcode: uint8(r.TTL >> 24),
+		Version:  uint8(r.TTL >> 16),
+		DO:       r.TTL&(1<<15) != 0,
+		Options:  r.RData,
+	}
+}
@@ -0,0 +1,84 @@
+package dns
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// ReverseZone returns the labels of the ip6.arpa or in-addr.arpa zone that
+// holds the reverse names of the addresses in p.
+//
+// The length of p must be a multiple of 4 for IPv6, as each label holds a
+// nibble, or of 8 for IPv4.
+func ReverseZone(p netip.Prefix) ([]string, error) {
+	p = p.Masked()
+	addr := p.Addr()
+
+	step, base, suffix := 4, 16, []string{"ip6", "arpa"}
+	if addr.Is4() {
+		step, base, suffix = 8, 10, []string{"in-addr", "arpa"}
+	}
+
+	if p.Bits()%step != 0 {
+		return nil, fmt.Errorf("the length of %v is not a multiple of %d", p, step)
+	}
+
+	labels := make([]string, 0, p.Bits()/step+len(suffix))
+	b := addr.AsSlice()
+	for i := p.Bits()/step - 1; i >= 0; i-- {
+		v := int(b[i*step/8])
+		if step == 4 {
+			if i%2 == 0 {
+				v >>= 4
+			}
+			v &= 0xf
+		}
+		labels = append(labels, strconv.FormatInt(int64(v), base))
+	}
+
+	return append(labels, suffix...), nil
+}
+
+// ReverseName parses the labels of a name in ip6.arpa or in-addr.arpa.
+//
+// The name need not be of a single address; the prefix covering every
+// address under it is returned, e.g. fd00::/16 for 0.0.d.f.ip6.arpa.
+func ReverseName(labels []string) (netip.Prefix, bool) {
+	n := len(labels) - 2
+	if n < 0 {
+		return netip.Prefix{}, false
+	}
+
+	switch suffix := strings.ToLower(strings.Join(labels[n:], ".")); {
+	case suffix == "ip6.arpa" && n <= 32:
+		var b [16]byte
+		for i := 0; i < n; i++ {
+			v, err := strconv.ParseUint(labels[n-1-i], 16, 4)
+			if err != nil || len(labels[n-1-i]) != 1 {
+				return netip.Prefix{}, false
+			}
+
+			if i%2 == 0 {
+				b[i/2] |= byte(v) << 4
+			} else {
+				b[i/2] |= byte(v)
+			}
+		}
+		return netip.PrefixFrom(netip.AddrFrom16(b), n*4), true
+	case suffix == "in-addr.arpa" && n <= 4:
+		var b [4]byte
+		for i := 0; i < n; i++ {
+			l := labels[n-1-i]
+			v, err := strconv.ParseUint(l, 10, 8)
+			if err != nil || (len(l) > 1 && l[0] == '0') {
+				return netip.Prefix{}, false
+			}
+			b[i] = byte(v)
+		}
+		return netip.PrefixFrom(netip.AddrFrom4(b), n*8), true
+	}
+
+	return netip.Prefix{}, false
+}
@@ -0,0 +1,59 @@
+package dns
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestReverseZone(t *testing.T) {
+	tests := []struct {
+		prefix string
+		exp    string
+	}{
+		{"fd00::/32", "0.0.0.0.0.0.d.f.ip6.arpa"},
+		{"fd12:3400::/24", "4.3.2.1.d.f.ip6.arpa"},
+		{"10.1.0.0/16", "1.10.in-addr.arpa"},
+		{"::/0", "ip6.arpa"},
+	}
+
+	for _, v := range tests {
+		got, err := ReverseZone(netip.MustParsePrefix(v.prefix))
+		if err != nil {
+			t.Errorf("ReverseZone(%s) = %v", v.prefix, err)
+		} else if strings.Join(got, ".") != v.exp {
+			t.Errorf("ReverseZone(%s) = %s, expected %s", v.prefix, strings.Join(got, "."), v.exp)
+		}
+	}
+
+	if _, err := ReverseZone(netip.MustParsePrefix("fd00::/30")); err == nil {
+		t.Errorf("ReverseZone accepted a prefix that is not nibble aligned")
+	}
+}
+
+func TestReverseName(t *testing.T) {
+	tests := []struct {
+		name string
+		exp  string
+	}{
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa", "fd00::1/128"},
+		{"0.0.D.F.IP6.ARPA", "fd00::/16"},
+		{"ip6.arpa", "::/0"},
+		{"4.3.2.1.in-addr.arpa", "1.2.3.4/32"},
+		{"2.1.in-addr.arpa", "1.2.0.0/16"},
+		{"g.d.f.ip6.arpa", ""},
+		{"10.d.f.ip6.arpa", ""},
+		{"01.in-addr.arpa", ""},
+		{"256.in-addr.arpa", ""},
+		{"example.com", ""},
+	}
+
+	for _, v := range tests {
+		got, ok := ReverseName(strings.Split(v.name, "."))
+		if !ok && v.exp != "" {
+			t.Errorf("ReverseName(%s) failed, expected %s", v.name, v.exp)
+		} else if ok && got.String() != v.exp {
+			t.Errorf("ReverseName(%s) = %v, expected %q", v.name, got, v.exp)
+		}
+	}
+}
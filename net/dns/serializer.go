@@ -6,6 +6,7 @@ package dns
 // TODO: Compress outgoing queries.
 
 import (
+	"bytes"
 	"encoding/binary"
 	"io"
 )
@@ -38,6 +39,84 @@ func serializeLabels(w io.Writer, labels []string) (int, error) {
 	return n, err
 }
 
+// nameRData returns the record data of a record that holds a single name,
+// such as NS and PTR records.
+func nameRData(labels []string) []byte {
+	buf := &bytes.Buffer{}
+	serializeLabels(buf, labels)
+	return buf.Bytes()
+}
+
+// txtRData returns the record data of a TXT record, splitting strings that
+// are too long to fit in one character-string.
+func txtRData(txt []string) []byte {
+	buf := &bytes.Buffer{}
+	for _, v := range txt {
+		for {
+			n := len(v)
+			if n > 255 {
+				n = 255
+			}
+
+			buf.WriteByte(byte(n))
+			buf.WriteString(v[:n])
+
+			v = v[n:]
+			if len(v) == 0 {
+				break
+			}
+		}
+	}
+	return buf.Bytes()
+}
+
+// srvRData returns the record data of an SRV record.
+func srvRData(v SRV) []byte {
+	buf := &bytes.Buffer{}
+
+	var tmp [6]byte
+	binary.BigEndian.PutUint16(tmp[:2], v.Priority)
+	binary.BigEndian.PutUint16(tmp[2:4], v.Weight)
+	binary.BigEndian.PutUint16(tmp[4:], v.Port)
+	buf.Write(tmp[:])
+
+	serializeLabels(buf, splitName(v.Target))
+	return buf.Bytes()
+}
+
+// soaRData returns the record data of an SOA record.
+func soaRData(mname, rname []string, serial, refresh, retry, expire, minimum uint32) []byte {
+	buf := &bytes.Buffer{}
+	serializeLabels(buf, mname)
+	serializeLabels(buf, rname)
+
+	var tmp [20]byte
+	binary.BigEndian.PutUint32(tmp[:4], serial)
+	binary.BigEndian.PutUint32(tmp[4:8], refresh)
+	binary.BigEndian.PutUint32(tmp[8:12], retry)
+	binary.BigEndian.PutUint32(tmp[12:16], expire)
+	binary.BigEndian.PutUint32(tmp[16:], minimum)
+	buf.Write(tmp[:])
+
+	return buf.Bytes()
+}
+
+// record returns the OPT record that holds the options.
+func (e dnsEDNS) record() dnsRecord {
+	ttl := uint32(e.ExtRcode)<<24 | uint32(e.Version)<<16
+	if e.DO {
+		ttl |= 1 << 15
+	}
+
+	return dnsRecord{
+		Labels: nil,
+		Type:   typeOPT,
+		Class:  dnsClass(e.UDPSize),
+		TTL:    ttl,
+		RData:  e.Options,
+	}
+}
+
 // serialize serializes the question to the writer.
 func (q dnsQuestion) serialize(w io.Writer) (int, error) {
 	n, err := serializeLabels(w, q.Labels)
@@ -101,11 +180,16 @@ func (m dnsMessage) serialize(w io.Writer) (int, error) {
 	}
 	tmp[3] |= uint8(m.Resp) & 0b1111
 
+	additional := m.Additional
+	if m.EDNS != nil {
+		additional = append(additional[:len(additional):len(additional)], m.EDNS.record())
+	}
+
 	// Ignoring other values intentionally
 	binary.BigEndian.PutUint16(tmp[4:6], uint16(len(m.Questions)))
 	binary.BigEndian.PutUint16(tmp[6:8], uint16(len(m.Answers)))
 	binary.BigEndian.PutUint16(tmp[8:10], uint16(len(m.Authority)))
-	binary.BigEndian.PutUint16(tmp[10:12], uint16(len(m.Additional)))
+	binary.BigEndian.PutUint16(tmp[10:12], uint16(len(additional)))
 
 	n, err := w.Write(tmp[:])
 	if err != nil {
@@ -138,7 +222,7 @@ func (m dnsMessage) serialize(w io.Writer) (int, error) {
 		}
 	}
 
-	for _, v := range m.Additional {
+	for _, v := range additional {
 		s, err := v.serialize(w)
 		n += s
 		if err != nil {
@@ -73,6 +73,33 @@ func TestSerialize(t *testing.T) {
 				},
 			},
 		},
+		{
+			"query example.com with EDNS0",
+			[]byte{
+				0xc2, 0x22, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00,
+				0x00, 0x00, 0x00, 0x01, 0x07, 0x65, 0x78, 0x61,
+				0x6d, 0x70, 0x6c, 0x65, 0x03, 0x63, 0x6f, 0x6d,
+				0x00, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x29,
+				0x04, 0xd0, 0x00, 0x00, 0x80, 0x00, 0x00, 0x00,
+			},
+			dnsMessage{
+				ID:     0xc222,
+				QR:     true,
+				Opcode: opQuery,
+				RD:     true,
+				Questions: []dnsQuestion{
+					{
+						Labels: []string{"example", "com"},
+						Type:   typeA,
+						Class:  classIN,
+					},
+				},
+				EDNS: &dnsEDNS{
+					UDPSize: 1232,
+					DO:      true,
+				},
+			},
+		},
 	}
 
 	for _, v := range tests {
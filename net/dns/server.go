@@ -4,10 +4,41 @@ package dns
 
 import (
 	"bytes"
+	"errors"
 	"net"
+	"strings"
 	"sync"
+	"time"
 )
 
+// DefaultTTL is how long answers may be cached for if Server.TTL is zero.
+const DefaultTTL = 60
+
+// Name holds the records of a name in a Pikonet zone.
+type Name struct {
+	// IP holds the addresses of the name, which are answered with A
+	// records for IPv4 addresses and AAAA records for IPv6 ones.
+	IP []net.IP
+
+	// PTR holds the names that the name points to, such as for reverse
+	// lookups.
+	PTR []string
+
+	// TXT holds arbitrary strings describing the name.
+	TXT []string
+
+	// SRV holds services that may be found through the name.
+	SRV []SRV
+}
+
+// SRV describes where a service may be found.
+type SRV struct {
+	Priority uint16
+	Weight   uint16
+	Port     uint16
+	Target   string
+}
+
 // Server implements a basic DNS server that attempts to resolve for Pikonet
 // first, but then falls back on other DNS servers.
 type Server struct {
@@ -17,21 +48,55 @@ type Server struct {
 	// If empty, then queries that reach this point return NXDOMAIN.
 	Fallback string
 
-	// Resolve is the function called when a DNS query is received.
+	// Resolve is the function called when a DNS query is received, with
+	// the suffix that it matched and the lowercase labels that come before
+	// it, of which there is at least one.
+	// If ok is false, the name does not exist and NXDOMAIN is returned.
+	//
 	// If nil, then the server essentially acts as a proxy to the fallback
 	// DNS servers.
-	Resolve func(query []string) (result net.IP, ok bool)
+	Resolve func(suffix, query []string) (result Name, ok bool)
 
-	// Suffix holds the domain suffix (such as "com" for a domain that is
-	// or ends with ".com").
-	// When a query that matches this suffix is received, then the query
-	// calls Resolve.
+	// Suffixes holds the domain suffixes (such as ["com"] for a domain that
+	// is or ends with ".com") that we resolve for.
+	// When a query that matches one of these suffixes is received, then
+	// the query calls Resolve.
 	//
 	// If empty, then the server essentially acts as a proxy to the
 	// fallback DNS servers.
-	Suffix []string
+	//
+	// Each suffix is the apex of a zone, which has SOA and NS records
+	// naming this server.
+	Suffixes [][]string
+
+	// TTL is how long answers may be cached for, in seconds.
+	// If zero, DefaultTTL is used.
+	TTL uint32
+
+	// NegativeTTL is how long answers saying that a name or record does
+	// not exist may be cached for, in seconds.
+	// If zero, TTL is used.
+	NegativeTTL uint32
 }
 
+const (
+	// minUDPSize is the size of the largest UDP message that every client
+	// can receive.
+	minUDPSize = 512
+
+	// ednsUDPSize is the size of the largest UDP message that we accept,
+	// and that we send to clients that support EDNS0, which is small
+	// enough not to be fragmented.
+	ednsUDPSize = 1232
+
+	// fallbackTimeout is how long the fallback server has to answer.
+	fallbackTimeout = 5 * time.Second
+
+	// tcpIdleTimeout is how long a TCP connection is kept open without
+	// receiving a query.
+	tcpIdleTimeout = 10 * time.Second
+)
+
 var (
 	bbufPool = sync.Pool{
 		New: func() any {
@@ -40,17 +105,27 @@ var (
 	}
 )
 
-// canResolve returns true if the value of our suffix is found at the end of
-// labels.
-func (s *Server) canResolve(labels []string) bool {
-	if len(labels) < len(s.Suffix) {
+// suffix returns the suffix in Suffixes that is found at the end of labels,
+// or nil if there is none.
+func (s *Server) suffix(labels []string) []string {
+	for _, suf := range s.Suffixes {
+		if hasSuffix(labels, suf) {
+			return suf
+		}
+	}
+	return nil
+}
+
+// hasSuffix returns true if labels ends with suffix.
+func hasSuffix(labels, suffix []string) bool {
+	if len(labels) < len(suffix) {
 		return false
 	}
 
-	labels = labels[len(labels)-len(s.Suffix):]
+	labels = labels[len(labels)-len(suffix):]
 
-	for i := 0; i < len(s.Suffix); i++ {
-		if labels[i] != s.Suffix[i] {
+	for i := 0; i < len(suffix); i++ {
+		if !strings.EqualFold(labels[i], suffix[i]) {
 			return false
 		}
 	}
@@ -58,73 +133,232 @@ func (s *Server) canResolve(labels []string) bool {
 	return true
 }
 
-// fail sends an error message to the client.
-func (s *Server) fail(uc *net.UDPConn, addr *net.UDPAddr, msg dnsMessage, code dnsRespCode) error {
-	buf := bbufPool.Get().(*bytes.Buffer)
-	buf.Reset()
-	defer bbufPool.Put(buf)
-
-	retMsg := dnsMessage{
+// failure returns a response to msg that only carries code.
+func failure(msg dnsMessage, code dnsRespCode) dnsMessage {
+	return dnsMessage{
 		ID:        msg.ID,
 		QR:        false,
+		RD:        msg.RD,
 		RA:        true,
 		Opcode:    opQuery,
 		Resp:      code,
 		Questions: msg.Questions,
 	}
-
-	retMsg.serialize(buf)
-
-	_, err := uc.WriteTo(buf.Bytes(), addr)
-	return err
 }
 
-// fallbackResolve attempts to resolve the DNS query using the fallback resolvers.
-// Otherwise, it returns NXDOMAIN.
-func (s *Server) fallbackResolve(uc *net.UDPConn, addr *net.UDPAddr, msg dnsMessage) error {
-	if s.Fallback == "" {
-		return s.fail(uc, addr, msg, respNXDomain)
-	}
-
-	// Reserialize the query.
+// exchange sends msg to the fallback server over network, which is either
+// "udp" or "tcp", and returns its response.
+func (s *Server) exchange(network string, msg dnsMessage) (dnsMessage, error) {
 	buf := bbufPool.Get().(*bytes.Buffer)
 	buf.Reset()
 	defer bbufPool.Put(buf)
 
 	msg.serialize(buf)
 
-	c, err := net.Dial("udp", s.Fallback)
+	c, err := net.DialTimeout(network, s.Fallback, fallbackTimeout)
 	if err != nil {
-		return err
+		return dnsMessage{}, err
 	}
 	defer c.Close()
 
-	// Write out our message to the other end.
-	c.Write(buf.Bytes())
+	c.SetDeadline(time.Now().Add(fallbackTimeout))
 
-	// TODO: Should this be a pool?
-	respBuf := make([]byte, 64*1024)
-	n, err := c.Read(respBuf)
+	var respBuf []byte
+	if network == "tcp" {
+		if err := writeTCP(c, buf.Bytes()); err != nil {
+			return dnsMessage{}, err
+		}
+
+		respBuf, err = readTCP(c)
+	} else {
+		if _, err := c.Write(buf.Bytes()); err != nil {
+			return dnsMessage{}, err
+		}
+
+		// TODO: Should this be a pool?
+		respBuf = make([]byte, 64*1024)
+		var n int
+		n, err = c.Read(respBuf)
+		respBuf = respBuf[:n]
+	}
 	if err != nil {
-		return err
+		return dnsMessage{}, err
 	}
 
-	// We need to parse the DNS message and notify someone
-	// if it's a valid response.
-	msg, err = parseDNSMessage(respBuf[:n])
+	resp, err := parseDNSMessage(respBuf)
 	if err != nil {
-		return err
+		return resp, err
+	} else if resp.ID != msg.ID {
+		return resp, errors.New("response does not match the query")
 	}
+	return resp, nil
+}
 
-	buf.Reset()
-	msg.RA = true
-	msg.serialize(buf)
-	_, err = uc.WriteTo(buf.Bytes(), addr)
-	return err
+// fallbackResolve attempts to resolve the DNS query using the fallback
+// resolvers, retrying over TCP if the answer did not fit in a datagram.
+// Otherwise, it returns NXDOMAIN.
+func (s *Server) fallbackResolve(msg dnsMessage) (dnsMessage, error) {
+	if s.Fallback == "" {
+		return failure(msg, respNXDomain), nil
+	}
+
+	// EDNS0 options only apply to a single hop, so ask for answers as
+	// large as we take.
+	msg.EDNS = &dnsEDNS{
+		UDPSize: ednsUDPSize,
+		DO:      msg.EDNS != nil && msg.EDNS.DO,
+	}
+
+	resp, err := s.exchange("udp", msg)
+	if err == nil && resp.TC {
+		resp, err = s.exchange("tcp", msg)
+	}
+	if err != nil {
+		return resp, err
+	}
+
+	resp.RA = true
+	return resp, nil
+}
+
+// splitName splits a domain name into its labels.
+func splitName(name string) []string {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" {
+		return nil
+	}
+	return strings.Split(name, ".")
 }
 
-// handleQuery handles a DNS query.
-func (s *Server) handleQuery(uc *net.UDPConn, addr *net.UDPAddr, msg dnsMessage) error {
+// ttl returns the TTL of answers.
+func (s *Server) ttl() uint32 {
+	if s.TTL == 0 {
+		return DefaultTTL
+	}
+	return s.TTL
+}
+
+// negativeTTL returns the TTL of negative answers.
+func (s *Server) negativeTTL() uint32 {
+	if s.NegativeTTL == 0 {
+		return s.ttl()
+	}
+	return s.NegativeTTL
+}
+
+// soa returns the SOA record of the zone at suffix.
+//
+// The server is the only name server of every zone, and zones are never
+// transferred, so the serial and timers hardly matter.
+func (s *Server) soa(suffix []string) dnsRecord {
+	return dnsRecord{
+		Labels: suffix,
+		Type:   typeSOA,
+		Class:  classIN,
+		TTL:    s.ttl(),
+		RData:  soaRData([]string{"localhost"}, append([]string{"hostmaster"}, suffix...), 1, 3600, 600, 86400, s.negativeTTL()),
+	}
+}
+
+// records returns the records of name that answer q.
+// apex is true if the name is the suffix itself.
+func (s *Server) records(q dnsQuestion, suffix []string, apex bool, name Name) []dnsRecord {
+	recs := []dnsRecord{}
+	add := func(typ dnsType, rdata []byte) {
+		if q.Type == typ || q.Type == typeAny {
+			recs = append(recs, dnsRecord{
+				Labels: q.Labels,
+				Type:   typ,
+				Class:  classIN,
+				TTL:    s.ttl(),
+				RData:  rdata,
+			})
+		}
+	}
+
+	if apex {
+		if q.Type == typeSOA || q.Type == typeAny {
+			soa := s.soa(suffix)
+			soa.Labels = q.Labels
+			recs = append(recs, soa)
+		}
+		add(typeNS, nameRData([]string{"localhost"}))
+	}
+
+	for _, v := range name.IP {
+		if ip4 := v.To4(); ip4 != nil {
+			add(typeA, []byte(ip4))
+		} else if len(v) == net.IPv6len {
+			add(typeAAAA, []byte(v))
+		}
+	}
+
+	for _, v := range name.PTR {
+		add(typePTR, nameRData(splitName(v)))
+	}
+
+	if len(name.TXT) != 0 {
+		add(typeTXT, txtRData(name.TXT))
+	}
+
+	for _, v := range name.SRV {
+		add(typeSRV, srvRData(v))
+	}
+
+	return recs
+}
+
+// resolve answers a query for a name within suffix.
+func (s *Server) resolve(msg dnsMessage, suffix []string) dnsMessage {
+	q := msg.Questions[0]
+	resp := dnsMessage{
+		ID:        msg.ID,
+		Opcode:    opQuery,
+		AA:        true,
+		RD:        msg.RD,
+		RA:        true,
+		Questions: msg.Questions,
+	}
+
+	if q.Class != classIN && q.Class != classAny {
+		resp.AA = false
+		resp.Resp = respNotImplemented
+		return resp
+	}
+
+	labels := make([]string, len(q.Labels)-len(suffix))
+	for i := range labels {
+		labels[i] = strings.ToLower(q.Labels[i])
+	}
+
+	// The apex of the zone exists, but only has SOA and NS records.
+	name, ok := Name{}, true
+	if len(labels) != 0 {
+		name, ok = s.Resolve(suffix, labels)
+	}
+
+	if !ok {
+		resp.Resp = respNXDomain
+	} else {
+		resp.Answers = s.records(q, suffix, len(labels) == 0, name)
+	}
+
+	if len(resp.Answers) == 0 {
+		// Negative answers carry the SOA of the zone so that they may
+		// be cached; the name exists but has no records of this type
+		// if the response code is still respOk.
+		soa := s.soa(suffix)
+		soa.TTL = s.negativeTTL()
+		resp.Authority = []dnsRecord{soa}
+	}
+
+	return resp
+}
+
+// answer returns the response to the query msg.
+func (s *Server) answer(msg dnsMessage) dnsMessage {
+	var resp dnsMessage
+
 	if len(msg.Questions) != 1 {
 		// Literally nobody supports having more than 1 question in a
 		// query, despite the packet format supporting it.
@@ -132,42 +366,64 @@ func (s *Server) handleQuery(uc *net.UDPConn, addr *net.UDPAddr, msg dnsMessage)
 		// aren't (well) defined.
 		//
 		// Also, we will fail zero queries.
-		return s.fail(uc, addr, msg, respFormatErr)
+		resp = failure(msg, respFormatErr)
+	} else if msg.EDNS != nil && msg.EDNS.Version != 0 {
+		// We only know version 0; the extended code 16 is BADVERS.
+		resp = failure(msg, respOk)
+		resp.EDNS = &dnsEDNS{ExtRcode: 1}
+	} else if suffix := s.suffix(msg.Questions[0].Labels); suffix != nil && s.Resolve != nil {
+		// We can handle this query.
+		resp = s.resolve(msg, suffix)
+	} else if fresp, err := s.fallbackResolve(msg); err != nil {
+		resp = failure(msg, respServerFail)
+	} else {
+		resp = fresp
 	}
 
-	// Determine if we can't handle this query.
-	if msg.Questions[0].Type != typeAAAA && s.canResolve(msg.Questions[0].Labels) {
-		// Domain found but no A record.
-		return s.fail(uc, addr, msg, respOk)
-	} else if !s.canResolve(msg.Questions[0].Labels) || s.Resolve == nil {
-		return s.fallbackResolve(uc, addr, msg)
+	// Only answer with EDNS0 if the client asked with it, and replace
+	// the options of the fallback server with ours.
+	if msg.EDNS == nil {
+		resp.EDNS = nil
+	} else {
+		edns := &dnsEDNS{UDPSize: ednsUDPSize, DO: msg.EDNS.DO}
+		if resp.EDNS != nil {
+			edns.ExtRcode = resp.EDNS.ExtRcode
+		}
+		resp.EDNS = edns
 	}
 
-	// We can handle this query.
-	buf := bbufPool.Get().(*bytes.Buffer)
-	buf.Reset()
-	defer bbufPool.Put(buf)
+	return resp
+}
 
-	result, ok := s.Resolve(msg.Questions[0].Labels[:len(msg.Questions[0].Labels)-len(s.Suffix)])
-	if !ok {
-		return s.fail(uc, addr, msg, respNXDomain)
+// udpLimit returns the size of the largest UDP response that the sender of
+// msg can receive.
+func udpLimit(msg dnsMessage) int {
+	if msg.EDNS == nil || msg.EDNS.UDPSize < minUDPSize {
+		return minUDPSize
+	} else if msg.EDNS.UDPSize > ednsUDPSize {
+		return ednsUDPSize
 	}
+	return int(msg.EDNS.UDPSize)
+}
 
-	msg.Answers = append(msg.Answers, dnsRecord{
-		Labels: msg.Questions[0].Labels,
-		Type:   msg.Questions[0].Type,
-		Class:  msg.Questions[0].Class,
-		TTL:    600, // TODO
-		RData:  []byte(result),
-	})
-	msg.QR = false
-	msg.RA = true
+// pack serializes resp into buf. If it is larger than limit, every record is
+// left out and TC is set, so that the client retries over TCP.
+func pack(buf *bytes.Buffer, resp dnsMessage, limit int) {
+	buf.Reset()
+	resp.serialize(buf)
+	if buf.Len() <= limit {
+		return
+	}
 
-	msg.serialize(buf)
-	_, err := uc.WriteTo(buf.Bytes(), addr)
-	return err
+	resp.TC = true
+	resp.Answers, resp.Authority, resp.Additional = nil, nil, nil
+
+	buf.Reset()
+	resp.serialize(buf)
 }
 
+// Listen listens for DNS queries on addr over both UDP and TCP and answers
+// them.
 func (s *Server) Listen(addr *net.UDPAddr) error {
 	uc, err := net.ListenUDP("udp4", addr)
 	if err != nil {
@@ -175,6 +431,27 @@ func (s *Server) Listen(addr *net.UDPAddr) error {
 	}
 	defer uc.Close()
 
+	// Use the same port if we were given none.
+	port := uc.LocalAddr().(*net.UDPAddr).Port
+	l, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: addr.IP, Port: port})
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	errCh := make(chan error, 2)
+	go func() {
+		errCh <- s.Serve(uc)
+	}()
+	go func() {
+		errCh <- s.ServeTCP(l)
+	}()
+
+	return <-errCh
+}
+
+// Serve answers DNS queries received on uc until it is closed.
+func (s *Server) Serve(uc *net.UDPConn) error {
 	// TODO: Can this be done better?
 	buf := make([]byte, 64*1024)
 	for {
@@ -190,13 +467,18 @@ func (s *Server) Listen(addr *net.UDPAddr) error {
 		go func() {
 			defer bbufPool.Put(nbuf)
 
+			// The labels of msg point into nbuf.
+			out := bbufPool.Get().(*bytes.Buffer)
+			defer bbufPool.Put(out)
+
 			msg, err := parseDNSMessage(nbuf.Bytes())
 			if err != nil {
-				s.fail(uc, addr.(*net.UDPAddr), msg, respFormatErr)
-				return
+				pack(out, failure(msg, respFormatErr), minUDPSize)
+			} else {
+				pack(out, s.answer(msg), udpLimit(msg))
 			}
 
-			s.handleQuery(uc, addr.(*net.UDPAddr), msg)
+			uc.WriteTo(out.Bytes(), addr)
 		}()
 	}
 }
@@ -0,0 +1,130 @@
+package dns
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+func testServer() *Server {
+	return &Server{
+		Suffixes: [][]string{{"pn", "local"}},
+		Resolve: func(suffix, q []string) (Name, bool) {
+			switch strings.Join(q, ".") {
+			case "laptop":
+				return Name{
+					IP:  []net.IP{net.ParseIP("fd00::1")},
+					TXT: []string{"device-id=1"},
+				}, true
+			case "dual":
+				return Name{IP: []net.IP{net.ParseIP("fd00::2"), net.ParseIP("10.0.0.2")}}, true
+			case "_wireguard._udp.laptop":
+				return Name{SRV: []SRV{{Port: 51820, Target: "laptop.pn.local"}}}, true
+			}
+			return Name{}, false
+		},
+	}
+}
+
+func query(name string, typ dnsType) dnsMessage {
+	return dnsMessage{
+		ID: 1,
+		QR: true,
+		RD: true,
+		Questions: []dnsQuestion{{
+			Labels: strings.Split(name, "."),
+			Type:   typ,
+			Class:  classIN,
+		}},
+	}
+}
+
+func TestResolve(t *testing.T) {
+	tests := []struct {
+		name    string
+		typ     dnsType
+		resp    dnsRespCode
+		answers []dnsType
+	}{
+		{"laptop.pn.local", typeAAAA, respOk, []dnsType{typeAAAA}},
+		{"LAPTOP.pn.Local", typeAAAA, respOk, []dnsType{typeAAAA}},
+		{"laptop.pn.local", typeA, respOk, nil},
+		{"laptop.pn.local", typeTXT, respOk, []dnsType{typeTXT}},
+		{"laptop.pn.local", typeAny, respOk, []dnsType{typeAAAA, typeTXT}},
+		{"dual.pn.local", typeA, respOk, []dnsType{typeA}},
+		{"_wireguard._udp.laptop.pn.local", typeSRV, respOk, []dnsType{typeSRV}},
+		{"nobody.pn.local", typeAAAA, respNXDomain, nil},
+		{"pn.local", typeSOA, respOk, []dnsType{typeSOA}},
+		{"pn.local", typeNS, respOk, []dnsType{typeNS}},
+		{"pn.local", typeAAAA, respOk, nil},
+	}
+
+	s := testServer()
+	for _, v := range tests {
+		t.Run(fmt.Sprintf("%s/%d", v.name, v.typ), func(t *testing.T) {
+			msg := query(v.name, v.typ)
+
+			suffix := s.suffix(msg.Questions[0].Labels)
+			if suffix == nil {
+				t.Fatalf("%s is not in a zone", v.name)
+			}
+
+			resp := s.resolve(msg, suffix)
+			if resp.Resp != v.resp {
+				t.Errorf("response code %d, expected %d", resp.Resp, v.resp)
+			}
+			if !resp.AA || !resp.RD || resp.QR {
+				t.Errorf("AA = %v, RD = %v, QR = %v", resp.AA, resp.RD, resp.QR)
+			}
+
+			if len(resp.Answers) != len(v.answers) {
+				t.Fatalf("got %d answers, expected %d", len(resp.Answers), len(v.answers))
+			}
+			for i, a := range resp.Answers {
+				if a.Type != v.answers[i] {
+					t.Errorf("answer %d has type %v, expected %v", i, a.Type, v.answers[i])
+				}
+			}
+
+			// Negative answers carry the SOA.
+			if len(v.answers) == 0 && (len(resp.Authority) != 1 || resp.Authority[0].Type != typeSOA) {
+				t.Errorf("authority = %v, expected an SOA record", resp.Authority)
+			}
+		})
+	}
+}
+
+func TestRData(t *testing.T) {
+	if got := txtRData([]string{"a", strings.Repeat("b", 300)}); len(got) != 2+1+255+1+45 || got[0] != 1 || got[2] != 255 {
+		t.Errorf("txtRData split long strings wrong: %v", got[:3])
+	}
+
+	srv := srvRData(SRV{Priority: 1, Weight: 2, Port: 3, Target: "a.b"})
+	if exp := []byte{0, 1, 0, 2, 0, 3, 1, 'a', 1, 'b', 0}; string(srv) != string(exp) {
+		t.Errorf("srvRData = %v, expected %v", srv, exp)
+	}
+}
+
+func TestNegativeTTL(t *testing.T) {
+	s := testServer()
+	s.TTL, s.NegativeTTL = 300, 5
+
+	msg := query("nobody.pn.local", typeAAAA)
+	resp := s.resolve(msg, s.suffix(msg.Questions[0].Labels))
+	if len(resp.Authority) != 1 || resp.Authority[0].TTL != 5 {
+		t.Fatalf("authority = %+v, expected an SOA with a TTL of 5", resp.Authority)
+	}
+
+	// The negative TTL is also the last field of the SOA.
+	rdata := resp.Authority[0].RData
+	if min := binary.BigEndian.Uint32(rdata[len(rdata)-4:]); min != 5 {
+		t.Errorf("SOA minimum = %d, expected 5", min)
+	}
+
+	msg = query("laptop.pn.local", typeAAAA)
+	if resp := s.resolve(msg, s.suffix(msg.Questions[0].Labels)); resp.Answers[0].TTL != 300 {
+		t.Errorf("answer TTL = %d, expected 300", resp.Answers[0].TTL)
+	}
+}
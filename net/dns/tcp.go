@@ -0,0 +1,99 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// readTCP reads a message from r that is preceded by its length, as they are
+// sent over TCP.
+func readTCP(r io.Reader) ([]byte, error) {
+	var tmp [2]byte
+	if _, err := io.ReadFull(r, tmp[:]); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, binary.BigEndian.Uint16(tmp[:]))
+	_, err := io.ReadFull(r, buf)
+	return buf, err
+}
+
+// writeTCP writes msg to w preceded by its length, as they are sent over TCP.
+func writeTCP(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf[:2], uint16(len(msg)))
+	copy(buf[2:], msg)
+
+	// A single write keeps the length and message in one segment.
+	_, err := w.Write(buf)
+	return err
+}
+
+// ServeTCP answers DNS queries received over the connections accepted from l
+// until it is closed, and then closes them.
+func (s *Server) ServeTCP(l net.Listener) error {
+	var (
+		conns   = map[net.Conn]bool{}
+		connsMu sync.Mutex
+	)
+
+	defer func() {
+		connsMu.Lock()
+		defer connsMu.Unlock()
+
+		for c := range conns {
+			c.Close()
+		}
+	}()
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		connsMu.Lock()
+		conns[c] = true
+		connsMu.Unlock()
+
+		go func() {
+			defer c.Close()
+			s.serveConn(c)
+
+			connsMu.Lock()
+			delete(conns, c)
+			connsMu.Unlock()
+		}()
+	}
+}
+
+// serveConn answers the queries received over c until it is closed or goes
+// idle.
+func (s *Server) serveConn(c net.Conn) {
+	out := bbufPool.Get().(*bytes.Buffer)
+	defer bbufPool.Put(out)
+
+	for {
+		c.SetDeadline(time.Now().Add(tcpIdleTimeout))
+
+		buf, err := readTCP(c)
+		if err != nil {
+			return
+		}
+
+		msg, err := parseDNSMessage(buf)
+		if err != nil {
+			pack(out, failure(msg, respFormatErr), 0xffff)
+		} else {
+			pack(out, s.answer(msg), 0xffff)
+		}
+
+		if err := writeTCP(c, out.Bytes()); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package dns
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+// compressedAnswer is the answer to "a.com A" from a server that compresses
+// names, both in owner names and in record data:
+//
+//	a.com CNAME b.net
+//	b.net CNAME c.net
+var compressedAnswer = []byte{
+	0x00, 0x00, 0x81, 0x80, 0x00, 0x01, 0x00, 0x02,
+	0x00, 0x00, 0x00, 0x00,
+	// a.com A
+	0x01, 'a', 0x03, 'c', 'o', 'm', 0x00, 0x00,
+	0x01, 0x00, 0x01,
+	// a.com CNAME b.net
+	0xc0, 0x0c, 0x00, 0x05, 0x00, 0x01, 0x00, 0x00,
+	0x00, 0x3c, 0x00, 0x07, 0x01, 'b', 0x03, 'n',
+	'e', 't', 0x00,
+	// b.net CNAME c.net, pointing into the first record.
+	0xc0, 0x23, 0x00, 0x05, 0x00, 0x01, 0x00, 0x00,
+	0x00, 0x3c, 0x00, 0x04, 0x01, 'c', 0xc0, 0x25,
+}
+
+// bigServer returns a server whose only name has a TXT record that is too
+// large to fit in a UDP message.
+func bigServer() *Server {
+	return &Server{
+		Suffixes: [][]string{{"big"}},
+		Resolve: func(suffix, q []string) (Name, bool) {
+			return Name{TXT: []string{strings.Repeat("a", 4000)}}, true
+		},
+	}
+}
+
+// serve starts s on a random local port over both UDP and TCP, and returns
+// its address.
+func serve(t *testing.T, s *Server) string {
+	t.Helper()
+
+	uc, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { uc.Close() })
+
+	l, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: uc.LocalAddr().(*net.UDPAddr).Port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go s.Serve(uc)
+	go s.ServeTCP(l)
+
+	return uc.LocalAddr().String()
+}
+
+// ask sends msg to addr over network and returns the response.
+func ask(t *testing.T, network, addr string, msg dnsMessage) dnsMessage {
+	t.Helper()
+
+	c, err := net.Dial(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	buf := &bytes.Buffer{}
+	msg.serialize(buf)
+
+	var resp []byte
+	if network == "tcp" {
+		if err := writeTCP(c, buf.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		if resp, err = readTCP(c); err != nil {
+			t.Fatal(err)
+		}
+	} else {
+		if _, err := c.Write(buf.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		resp = make([]byte, 64*1024)
+		n, err := c.Read(resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp = resp[:n]
+	}
+
+	rmsg, err := parseDNSMessage(resp)
+	if err != nil {
+		t.Fatalf("failed to parse response: %v", err)
+	}
+	return rmsg
+}
+
+func TestTruncate(t *testing.T) {
+	addr := serve(t, bigServer())
+
+	resp := ask(t, "udp", addr, query("name.big", typeTXT))
+	if !resp.TC || len(resp.Answers) != 0 {
+		t.Errorf("UDP: TC = %v with %d answers, expected a truncated response", resp.TC, len(resp.Answers))
+	}
+	if resp.EDNS != nil {
+		t.Errorf("UDP: got EDNS0 options for a query without them")
+	}
+
+	msg := query("name.big", typeTXT)
+	msg.EDNS = &dnsEDNS{UDPSize: 4096}
+	if resp := ask(t, "udp", addr, msg); !resp.TC || resp.EDNS == nil || resp.EDNS.UDPSize != ednsUDPSize {
+		t.Errorf("UDP with EDNS0: TC = %v, EDNS = %+v", resp.TC, resp.EDNS)
+	}
+
+	resp = ask(t, "tcp", addr, query("name.big", typeTXT))
+	if resp.TC || len(resp.Answers) != 1 {
+		t.Errorf("TCP: TC = %v with %d answers, expected the whole response", resp.TC, len(resp.Answers))
+	}
+}
+
+func TestFallbackTCP(t *testing.T) {
+	s := &Server{Fallback: serve(t, bigServer())}
+	addr := serve(t, s)
+
+	// The fallback server truncates its answer, so it must be asked again
+	// over TCP.
+	resp := ask(t, "tcp", addr, query("name.big", typeTXT))
+	if resp.Resp != respOk || resp.TC || len(resp.Answers) != 1 {
+		t.Fatalf("resp = %d, TC = %v with %d answers", resp.Resp, resp.TC, len(resp.Answers))
+	}
+	if l := len(resp.Answers[0].RData); l < 4000 {
+		t.Errorf("TXT record is %d bytes long, expected the whole record", l)
+	}
+
+	// And the answer is then too large for the client over UDP.
+	if resp := ask(t, "udp", addr, query("name.big", typeTXT)); !resp.TC {
+		t.Errorf("UDP response was not truncated")
+	}
+}
+
+func TestBadVersion(t *testing.T) {
+	msg := query("laptop.pn.local", typeAAAA)
+	msg.EDNS = &dnsEDNS{UDPSize: 1232, Version: 1}
+
+	resp := testServer().answer(msg)
+	if resp.EDNS == nil || resp.EDNS.ExtRcode != 1 || resp.EDNS.Version != 0 || len(resp.Answers) != 0 {
+		t.Errorf("resp = %+v, expected BADVERS", resp)
+	}
+}
+
+// serveRaw answers every query sent to a random local port over UDP and TCP
+// with resp, under the ID of the query. If truncate is true, UDP answers are
+// truncated instead.
+func serveRaw(t *testing.T, resp []byte, truncate bool) string {
+	t.Helper()
+
+	uc, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { uc.Close() })
+
+	l, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: uc.LocalAddr().(*net.UDPAddr).Port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	answer := func(query []byte) []byte {
+		b := append([]byte{}, resp...)
+		copy(b[:2], query[:2])
+		return b
+	}
+
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, addr, err := uc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			b := answer(buf[:n])
+			if truncate {
+				// Only keep the header and question.
+				b = b[:23]
+				b[2] |= 0b10
+				b[7] = 0
+			}
+			uc.WriteTo(b, addr)
+		}
+	}()
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			if query, err := readTCP(c); err == nil {
+				writeTCP(c, answer(query))
+			}
+			c.Close()
+		}
+	}()
+
+	return uc.LocalAddr().String()
+}
+
+func TestFallbackCompressed(t *testing.T) {
+	for _, truncate := range []bool{false, true} {
+		addr := serve(t, &Server{Fallback: serveRaw(t, compressedAnswer, truncate)})
+
+		for _, network := range []string{"udp", "tcp"} {
+			resp := ask(t, network, addr, query("a.com", typeA))
+			if resp.Resp != respOk || len(resp.Answers) != 2 {
+				t.Errorf("%s, truncate %v: resp = %d with %d answers", network, truncate, resp.Resp, len(resp.Answers))
+				continue
+			}
+
+			// The names must stand on their own.
+			for i, exp := range []string{"b.net", "c.net"} {
+				rdata := resp.Answers[i].RData
+				labels, _, err := parseLabels(rdata, rdata, 0)
+				if err != nil {
+					t.Errorf("%s, truncate %v: answer %d: %v", network, truncate, i, err)
+				} else if got := strings.Join(labels, "."); got != exp {
+					t.Errorf("%s, truncate %v: answer %d is %s, expected %s", network, truncate, i, got, exp)
+				}
+			}
+
+			if got := strings.Join(resp.Answers[1].Labels, "."); got != "b.net" {
+				t.Errorf("%s, truncate %v: owner of answer 1 is %s, expected b.net", network, truncate, got)
+			}
+		}
+	}
+}
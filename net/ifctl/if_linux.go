@@ -1,7 +1,9 @@
 package ifctl
 
 import (
+	"errors"
 	"net"
+	"syscall"
 
 	"github.com/vishvananda/netlink"
 )
@@ -64,7 +66,7 @@ func From(name string) (Interface, error) {
 
 // Name returns the name of the interface.
 func (li *linuxInterface) Name() string {
-	return li.linkAttrs.Name
+	return li.link.Attrs().Name
 }
 
 // Set sets the state of the interface to be up or down.
@@ -119,8 +121,11 @@ func (li *linuxInterface) DeleteRoute(route *net.IPNet) error {
 			li.routes[i], li.routes[len(li.routes)-1] = li.routes[len(li.routes)-1], li.routes[i]
 			li.routes = li.routes[:len(li.routes)-1]
 
-			// TODO: Determine if link is up or not so it does not error.
-			return netlink.RouteDel(&v)
+			// The route is already gone if the link was taken down.
+			if err := netlink.RouteDel(&v); err != nil && !errors.Is(err, syscall.ESRCH) {
+				return err
+			}
+			return nil
 		}
 	}
 
@@ -53,7 +53,7 @@ func From(name string) (Interface, error) {
 
 // Name returns the name of the interface.
 func (wi *winInterface) Name() string {
-	return wi.Name
+	return wi.name
 }
 
 // Set sets the state of the interface to be up or down.
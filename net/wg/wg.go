@@ -2,6 +2,8 @@ package wg
 
 import (
 	"encoding/base64"
+	"fmt"
+	"log"
 	"net"
 	"time"
 
@@ -35,16 +37,24 @@ type Device interface {
 	// A Peer already exists when a peer with the same key as publicKey has
 	// been previously added to the interface.
 	//
+	// If ip is specified, it replaces all allowed IPs of an existing peer
+	// and routes to the old ones are removed.
+	//
 	// endpoint may be nil, and ip may be empty, but not at the same time.
 	// publicKey must always be specified.
 	AddPeer(ip *net.IPNet, endpoint *net.UDPAddr, publicKey wgtypes.Key) error
 
-	// RemovePeer disconnects from the specified peer by their public key.
+	// RemovePeer disconnects from the specified peer by their public key,
+	// removing the routes to its allowed IPs.
 	//
 	// If the public key is not found in an existing peer, this function
 	// does nothing.
 	RemovePeer(publicKey wgtypes.Key) error
 
+	// Peers returns the current state of all peers on the interface, as
+	// reported by WireGuard.
+	Peers() ([]wgtypes.Peer, error)
+
 	// Interface returns the underlying interface.
 	Interface() ifctl.Interface
 
@@ -65,8 +75,39 @@ func ParseKey(key string) (wgtypes.Key, error) {
 	return wgtypes.Key(dst), nil
 }
 
-// New creates a new WireGuard device.
-func New(name string) (Device, error) {
-	// return newTUNWireguard(name)
-	return newNativeWireguard(name)
+// Backend selects the WireGuard implementation used by New.
+type Backend string
+
+const (
+	// BackendKernel uses the in-kernel implementation of WireGuard.
+	BackendKernel Backend = "kernel"
+
+	// BackendUserspace uses wireguard-go on top of a TUN device.
+	BackendUserspace Backend = "userspace"
+
+	// BackendAuto tries the in-kernel implementation first, and falls
+	// back to wireguard-go if the interface could not be created.
+	BackendAuto Backend = "auto"
+)
+
+// New creates a new WireGuard device using the specified backend.
+//
+// An empty backend is the same as BackendAuto.
+func New(name string, backend Backend) (Device, error) {
+	switch backend {
+	case BackendKernel:
+		return newNativeWireguard(name)
+	case BackendUserspace:
+		return newTUNWireguard(name)
+	case BackendAuto, "":
+		dev, err := newNativeWireguard(name)
+		if err == nil {
+			return dev, nil
+		}
+
+		log.Printf("net/wg: failed to create in-kernel interface, falling back to wireguard-go: %v", err)
+		return newTUNWireguard(name)
+	}
+
+	return nil, fmt.Errorf("unknown backend %q", backend)
 }
@@ -2,7 +2,6 @@ package wg
 
 import (
 	"fmt"
-	"log"
 	"net"
 
 	"github.com/mca3/pikonode/net/ifctl"
@@ -15,10 +14,17 @@ import (
 
 // wgctrlWireguard implements an interface to the in-kernel implementation of
 // WireGuard, using wgctrl.
+//
+// wgctrl can talk to wireguard-go just as well, so this is also used for
+// userspace devices.
 type wgctrlWireguard struct {
 	ifc ifctl.Interface
 	ifn string
 	wgc *wgctrl.Client
+
+	// stop shuts down wireguard-go.
+	// stop is nil for the in-kernel implementation.
+	stop func()
 }
 
 var (
@@ -84,15 +90,11 @@ func newTUNWireguard(name string) (Device, error) {
 	}
 
 	go func() {
-		defer t.Close()
-		defer il.Close()
-		defer dev.Close()
-		defer uapi.Close()
-
 		for {
 			conn, err := uapi.Accept()
 			if err != nil {
-				log.Fatal(err)
+				// Closed by stop.
+				return
 			}
 			go dev.IpcHandle(conn)
 		}
@@ -121,6 +123,12 @@ func newTUNWireguard(name string) (Device, error) {
 		ifc: ifc,
 		ifn: name,
 		wgc: wgc,
+		stop: func() {
+			uapi.Close()
+			dev.Close()
+			il.Close()
+			t.Close()
+		},
 	}
 
 	return nwg, nil
@@ -155,6 +163,22 @@ func (w *wgctrlWireguard) SetState(up bool) error {
 	return w.ifc.Set(up)
 }
 
+// peer looks up the current state of a peer by its public key.
+func (w *wgctrlWireguard) peer(publicKey wgtypes.Key) (wgtypes.Peer, bool, error) {
+	peers, err := w.Peers()
+	if err != nil {
+		return wgtypes.Peer{}, false, err
+	}
+
+	for _, v := range peers {
+		if v.PublicKey == publicKey {
+			return v, true, nil
+		}
+	}
+
+	return wgtypes.Peer{}, false, nil
+}
+
 // AddPeer adds a new peer or updates existing peer information.
 //
 // A Peer already exists when a peer with the same key as publicKey has
@@ -173,7 +197,22 @@ func (w *wgctrlWireguard) AddPeer(ip *net.IPNet, endpoint *net.UDPAddr, publicKe
 	}
 
 	if ip != nil {
+		// Drop the routes of any allowed IPs that we are about to
+		// replace.
+		old, ok, err := w.peer(publicKey)
+		if err != nil {
+			return err
+		} else if ok {
+			for _, v := range old.AllowedIPs {
+				v := v
+				if !v.IP.Equal(ip.IP) {
+					w.ifc.DeleteRoute(&v)
+				}
+			}
+		}
+
 		peer.AllowedIPs = []net.IPNet{*ip}
+		peer.ReplaceAllowedIPs = true
 
 		if err := w.ifc.AddRoute(ip); err != nil {
 			return err
@@ -190,17 +229,43 @@ func (w *wgctrlWireguard) AddPeer(ip *net.IPNet, endpoint *net.UDPAddr, publicKe
 // If the public key is not found in an existing peer, this function
 // does nothing.
 func (w *wgctrlWireguard) RemovePeer(publicKey wgtypes.Key) error {
+	old, ok, err := w.peer(publicKey)
+	if err != nil {
+		return err
+	} else if !ok {
+		return nil
+	}
+
 	peer := wgtypes.PeerConfig{
 		PublicKey: publicKey,
 		Remove:    true,
 	}
 
-	// TODO: Should be remove the route?
-	// Previously we would.
-
-	return w.wgc.ConfigureDevice(w.ifn, wgtypes.Config{
+	if err := w.wgc.ConfigureDevice(w.ifn, wgtypes.Config{
 		Peers: []wgtypes.PeerConfig{peer},
-	})
+	}); err != nil {
+		return err
+	}
+
+	for _, v := range old.AllowedIPs {
+		v := v
+		if err := w.ifc.DeleteRoute(&v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Peers returns the current state of all peers on the interface, as
+// reported by WireGuard.
+func (w *wgctrlWireguard) Peers() ([]wgtypes.Peer, error) {
+	dev, err := w.wgc.Device(w.ifn)
+	if err != nil {
+		return nil, err
+	}
+
+	return dev.Peers, nil
 }
 
 // Interface returns the underlying interface.
@@ -213,6 +278,13 @@ func (w *wgctrlWireguard) Close() error {
 	if err := w.wgc.Close(); err != nil {
 		return err
 	}
+
+	if w.stop != nil {
+		// The TUN device goes away with wireguard-go.
+		w.stop()
+		return nil
+	}
+
 	if err := w.ifc.Delete(); err != nil {
 		return err
 	}
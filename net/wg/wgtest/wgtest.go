@@ -0,0 +1,432 @@
+// Package wgtest implements in-memory versions of wg.Device and
+// ifctl.Interface for use in tests.
+//
+// Nothing in this package touches the network or requires root; all state is
+// recorded so that tests can inspect it afterwards.
+package wgtest
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mca3/pikonode/net/ifctl"
+	"github.com/mca3/pikonode/net/wg"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Interface is an in-memory ifctl.Interface.
+type Interface struct {
+	name    string
+	up      bool
+	deleted bool
+	addrs   []net.IPNet
+	routes  []net.IPNet
+	mu      sync.Mutex
+}
+
+// Device is an in-memory wg.Device.
+//
+// It mimics the behavior of the real implementation, including the management
+// of routes on its Interface.
+type Device struct {
+	ifc *Interface
+
+	privateKey wgtypes.Key
+	listenPort uint16
+	peers      []wgtypes.Peer
+	closed     bool
+
+	adds, removes int
+
+	mu sync.Mutex
+}
+
+var (
+	_ ifctl.Interface = &Interface{}
+	_ wg.Device       = &Device{}
+)
+
+// NewInterface creates a new Interface.
+//
+// Like a real interface, it starts out down.
+func NewInterface(name string) *Interface {
+	return &Interface{name: name}
+}
+
+// New creates a new Device with a new Interface.
+func New(name string) *Device {
+	return &Device{ifc: NewInterface(name)}
+}
+
+// Name returns the name of the interface.
+func (i *Interface) Name() string {
+	return i.name
+}
+
+// Set sets the state of the interface to be up or down.
+func (i *Interface) Set(state bool) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.up = state
+	return nil
+}
+
+// SetAddr sets the address of the interface to the one provided.
+func (i *Interface) SetAddr(addr *net.IPNet) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for _, v := range i.addrs {
+		if v.String() == addr.String() {
+			return nil
+		}
+	}
+
+	i.addrs = append(i.addrs, *addr)
+	return nil
+}
+
+// Add adds a route for an IPNet to the interface.
+func (i *Interface) AddRoute(route *net.IPNet) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for _, v := range i.routes {
+		if v.Contains(route.IP) {
+			return nil
+		}
+	}
+
+	i.routes = append(i.routes, *route)
+	return nil
+}
+
+// DeleteRoute removes a route for an IPNet to the interface.
+func (i *Interface) DeleteRoute(route *net.IPNet) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for j, v := range i.routes {
+		if v.Contains(route.IP) {
+			i.routes = append(i.routes[:j], i.routes[j+1:]...)
+			break
+		}
+	}
+
+	return nil
+}
+
+// Delete deletes the interface.
+func (i *Interface) Delete() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.deleted = true
+	i.up = false
+	return nil
+}
+
+// Up returns true if the interface is up.
+func (i *Interface) Up() bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.up
+}
+
+// Deleted returns true if the interface has been deleted.
+func (i *Interface) Deleted() bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.deleted
+}
+
+// Addrs returns all addresses that have been set on the interface.
+func (i *Interface) Addrs() []net.IPNet {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return append([]net.IPNet(nil), i.addrs...)
+}
+
+// Routes returns all routes on the interface.
+func (i *Interface) Routes() []net.IPNet {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return append([]net.IPNet(nil), i.routes...)
+}
+
+// HasRoute returns true if there is a route to ip on the interface.
+func (i *Interface) HasRoute(ip string) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	pip := net.ParseIP(ip)
+	for _, v := range i.routes {
+		if v.Contains(pip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SetKey sets the private key of the WireGuard interface.
+func (d *Device) SetKey(privateKey wgtypes.Key) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.privateKey = privateKey
+	return nil
+}
+
+// SetListenPort sets the listening port of the WireGuard interface.
+func (d *Device) SetListenPort(port uint16) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.listenPort = port
+	return nil
+}
+
+// SetIP sets the IP of the WireGuard interface.
+func (d *Device) SetIP(newIP *net.IPNet) error {
+	return d.ifc.SetAddr(newIP)
+}
+
+// SetState sets the state of the WireGuard interface to "up" (true) or
+// "down" (false).
+func (d *Device) SetState(up bool) error {
+	return d.ifc.Set(up)
+}
+
+// peer returns the index of a peer, or -1.
+func (d *Device) peer(publicKey wgtypes.Key) int {
+	for i, v := range d.peers {
+		if v.PublicKey == publicKey {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// AddPeer adds a new peer or updates existing peer information.
+func (d *Device) AddPeer(ip *net.IPNet, endpoint *net.UDPAddr, publicKey wgtypes.Key) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.adds++
+
+	i := d.peer(publicKey)
+	if i == -1 {
+		d.peers = append(d.peers, wgtypes.Peer{PublicKey: publicKey})
+		i = len(d.peers) - 1
+	}
+
+	p := &d.peers[i]
+
+	if endpoint != nil {
+		ep := *endpoint
+		p.Endpoint = &ep
+	}
+
+	if ip != nil {
+		for _, v := range p.AllowedIPs {
+			v := v
+			if !v.IP.Equal(ip.IP) {
+				d.ifc.DeleteRoute(&v)
+			}
+		}
+
+		p.AllowedIPs = []net.IPNet{*ip}
+		d.ifc.AddRoute(ip)
+	}
+
+	return nil
+}
+
+// RemovePeer disconnects from the specified peer by their public key.
+func (d *Device) RemovePeer(publicKey wgtypes.Key) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	i := d.peer(publicKey)
+	if i == -1 {
+		return nil
+	}
+
+	d.removes++
+
+	for _, v := range d.peers[i].AllowedIPs {
+		v := v
+		d.ifc.DeleteRoute(&v)
+	}
+
+	d.peers = append(d.peers[:i], d.peers[i+1:]...)
+	return nil
+}
+
+// Peers returns the current state of all peers on the interface.
+func (d *Device) Peers() ([]wgtypes.Peer, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return append([]wgtypes.Peer(nil), d.peers...), nil
+}
+
+// Interface returns the underlying interface.
+func (d *Device) Interface() ifctl.Interface {
+	return d.ifc
+}
+
+// Close closes the WireGuard interface and cleans up.
+func (d *Device) Close() error {
+	d.mu.Lock()
+	d.closed = true
+	d.mu.Unlock()
+
+	return d.ifc.Delete()
+}
+
+// Iface returns the underlying interface as an *Interface.
+func (d *Device) Iface() *Interface {
+	return d.ifc
+}
+
+// PrivateKey returns the private key that was last set.
+func (d *Device) PrivateKey() wgtypes.Key {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.privateKey
+}
+
+// ListenPort returns the listen port that was last set.
+func (d *Device) ListenPort() uint16 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.listenPort
+}
+
+// Closed returns true if the device has been closed.
+func (d *Device) Closed() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.closed
+}
+
+// Peer returns the state of a single peer.
+func (d *Device) Peer(publicKey wgtypes.Key) (wgtypes.Peer, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if i := d.peer(publicKey); i != -1 {
+		return d.peers[i], true
+	}
+
+	return wgtypes.Peer{}, false
+}
+
+// SetStats sets the statistics that are reported for a peer, as if traffic had
+// gone through it.
+func (d *Device) SetStats(publicKey wgtypes.Key, handshake time.Time, rx, tx int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if i := d.peer(publicKey); i != -1 {
+		d.peers[i].LastHandshakeTime = handshake
+		d.peers[i].ReceiveBytes = rx
+		d.peers[i].TransmitBytes = tx
+	}
+}
+
+// Changes returns the number of calls to AddPeer and the number of peers that
+// were removed since the last call to ResetChanges.
+func (d *Device) Changes() (adds, removes int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.adds, d.removes
+}
+
+// ResetChanges resets the counters returned by Changes.
+func (d *Device) ResetChanges() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.adds, d.removes = 0, 0
+}
+
+// AssertPeer fails the test if the peer does not exist, or if its allowed IP
+// or endpoint differs from the ones given.
+//
+// An empty ip or endpoint is not checked.
+func (d *Device) AssertPeer(t testing.TB, publicKey wgtypes.Key, ip, endpoint string) {
+	t.Helper()
+
+	p, ok := d.Peer(publicKey)
+	if !ok {
+		t.Errorf("peer %s does not exist", publicKey)
+		return
+	}
+
+	if ip != "" {
+		if len(p.AllowedIPs) != 1 || !p.AllowedIPs[0].IP.Equal(net.ParseIP(ip)) {
+			t.Errorf("peer %s has allowed IPs %v, expected %s", publicKey, p.AllowedIPs, ip)
+		}
+
+		if !d.ifc.HasRoute(ip) {
+			t.Errorf("peer %s has no route to %s", publicKey, ip)
+		}
+	}
+
+	if endpoint != "" {
+		if p.Endpoint == nil || p.Endpoint.String() != endpoint {
+			t.Errorf("peer %s has endpoint %v, expected %s", publicKey, p.Endpoint, endpoint)
+		}
+	}
+}
+
+// AssertNoPeer fails the test if the peer exists.
+func (d *Device) AssertNoPeer(t testing.TB, publicKey wgtypes.Key) {
+	t.Helper()
+
+	if _, ok := d.Peer(publicKey); ok {
+		t.Errorf("peer %s exists", publicKey)
+	}
+}
+
+// AssertRoute fails the test if there is no route to ip.
+func (i *Interface) AssertRoute(t testing.TB, ip string) {
+	t.Helper()
+
+	if !i.HasRoute(ip) {
+		t.Errorf("no route to %s on %s; routes are %v", ip, i.name, i.Routes())
+	}
+}
+
+// AssertNoRoute fails the test if there is a route to ip.
+func (i *Interface) AssertNoRoute(t testing.TB, ip string) {
+	t.Helper()
+
+	if i.HasRoute(ip) {
+		t.Errorf("route to %s exists on %s", ip, i.name)
+	}
+}
+
+// AssertUp fails the test if the interface is not in the expected state.
+func (i *Interface) AssertUp(t testing.TB, up bool) {
+	t.Helper()
+
+	if i.Up() != up {
+		t.Errorf("%s: up = %v, expected %v", i.name, !up, up)
+	}
+}
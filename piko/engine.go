@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"net/http"
 	"sync"
+	"sync/atomic"
 
 	"github.com/mca3/pikonode/api"
 )
@@ -22,13 +23,23 @@ type Engine struct {
 	ourDevice api.Device
 	gw        chan api.GatewayMsg
 
-	api *api.API
+	// api is replaced by Reconfigure, as the server of an api.API may not
+	// be changed once it is in use.
+	api atomic.Pointer[api.API]
 
 	onJoin    []func(nw *api.Network, dev *api.Device)
 	onLeave   []func(nw *api.Network, dev *api.Device)
 	onUpdate  []func(dev *api.Device)
 	onRebuild []func()
 
+	subs      subscribers
+	connected bool
+
+	// cancel stops the goroutines started by Connect, and running tracks
+	// them.
+	cancel  context.CancelFunc
+	running sync.WaitGroup
+
 	sync.Mutex
 }
 
@@ -46,23 +57,37 @@ type Config struct {
 
 	// ListenPort is the port that WireGuard communicates on.
 	ListenPort int
+
+	// Credentials, if set, is used to fetch a new token when the current
+	// one is rejected.
+	Credentials api.Credentials
+
+	// OnToken, if set, is called when the token changes.
+	OnToken func(token string)
 }
 
 // NewEngine creates a new instance of Engine.
 func NewEngine(cfg Config) (*Engine, error) {
 	e := &Engine{
 		cfg: cfg,
-		api: &api.API{
-			Server: cfg.Rendezvous,
-			Token:  cfg.Token,
-			HTTP:   http.DefaultClient,
-		},
-		gw: make(chan api.GatewayMsg, 100),
+		gw:  make(chan api.GatewayMsg, 100),
 	}
+	e.api.Store(newAPI(cfg))
 
 	return e, nil
 }
 
+// newAPI creates the api.API described by cfg.
+func newAPI(cfg Config) *api.API {
+	return &api.API{
+		Server:      cfg.Rendezvous,
+		Token:       cfg.Token,
+		Credentials: cfg.Credentials,
+		OnToken:     cfg.OnToken,
+		HTTP:        http.DefaultClient,
+	}
+}
+
 // deviceIsIn returns true if a device ID is found within a network.
 func deviceIsIn(needle api.Device, haystack []api.Device) bool {
 	for _, v := range haystack {
@@ -75,9 +100,9 @@ func deviceIsIn(needle api.Device, haystack []api.Device) bool {
 
 // fetchNetwork returns a reference to a network in the cache.
 func (e *Engine) fetchNetwork(id int64) *api.Network {
-	for _, v := range e.nwState {
-		if v.ID == id {
-			return &v
+	for i := range e.nwState {
+		if e.nwState[i].ID == id {
+			return &e.nwState[i]
 		}
 	}
 
@@ -91,7 +116,7 @@ func (e *Engine) rebuildState() {
 
 	e.nwState = e.nwState[:0]
 
-	nws, err := e.api.Networks(context.TODO())
+	nws, err := e.API().Networks(context.TODO())
 	if err != nil {
 		return
 		// return fmt.Errorf("failed to fetch networks: %v", err)
@@ -118,39 +143,18 @@ func (e *Engine) rebuildState() {
 	for _, v := range e.onRebuild {
 		v()
 	}
+
+	e.emit(Event{Type: EventRebuild})
 }
 
 // updatePeers updates the peer list.
 func (e *Engine) updatePeers() {
 	// Assuming we're still locked.
 
-	// Find old devices.
-	valid := 0
-	for _, d := range e.peerState {
-		if d.ID == e.ourDevice.ID {
-			// This should never be here.
-			continue
-		}
+	// The peer list is rebuilt from scratch so that changes to devices
+	// that we already know about are picked up.
+	e.peerState = e.peerState[:0]
 
-		ok := false
-		for _, v := range e.nwState {
-			if deviceIsIn(d, v.Devices) {
-				ok = true
-				break
-			}
-		}
-
-		if !ok {
-			continue
-		}
-
-		e.peerState[valid] = d
-		valid++
-	}
-
-	e.peerState = e.peerState[:valid]
-
-	// Find new devices
 	for _, v := range e.nwState {
 		for _, d := range v.Devices {
 			if d.ID == e.ourDevice.ID {
@@ -187,18 +191,28 @@ func (e *Engine) handleGwMsg(ctx context.Context, msg api.GatewayMsg) {
 	case api.DeviceUpdate:
 		e.handleUpdate(msg.Device)
 	case api.Connect:
+		e.setConnected(true)
+		e.emit(Event{Type: EventConnect})
 		e.rebuildState()
 	case api.Disconnect:
-		// log.Printf("Disconnected from rendezvous server. Error: %v", msg.Error)
-		// log.Printf("Reconnecting to rendezvous in %v", msg.Delay)
+		e.setConnected(false)
+		e.emit(Event{Type: EventDisconnect, Delay: msg.Delay, Error: msg.Error})
 	}
 }
 
+// setConnected updates the gateway connection state.
+func (e *Engine) setConnected(c bool) {
+	e.Lock()
+	defer e.Unlock()
+
+	e.connected = c
+}
+
 // handleSelfJoin handles joining a network that our device has been joined to.
 func (e *Engine) handleSelfJoin(nw *api.Network) {
 	// We are assuming that are still locked here.
 
-	_nw, err := e.api.Network(context.TODO(), nw.ID)
+	_nw, err := e.API().Network(context.TODO(), nw.ID)
 	if err != nil {
 		// TODO: Complain
 		return
@@ -242,6 +256,8 @@ done:
 	for _, v := range e.onJoin {
 		v(nw, dev)
 	}
+
+	e.emit(Event{Type: EventJoin, Network: nw, Device: dev})
 }
 
 // handleSelfLeave handles leaving a network that our device has left.
@@ -300,6 +316,8 @@ done:
 	for _, v := range e.onLeave {
 		v(nw, dev)
 	}
+
+	e.emit(Event{Type: EventLeave, Network: nw, Device: dev})
 }
 
 // handleUpdate handles a device updating its details.
@@ -332,24 +350,86 @@ func (e *Engine) handleUpdate(dev *api.Device) {
 	for _, v := range e.onUpdate {
 		v(dev)
 	}
+
+	e.emit(Event{Type: EventUpdate, Device: dev})
 }
 
 // Connect attempts to connect to the Rendezvous server.
 func (e *Engine) Connect() error {
+	a := e.API()
+
 	// Try to get our device
-	dev, err := e.api.Device(context.TODO(), e.cfg.DeviceID)
+	dev, err := a.Device(context.TODO(), e.cfg.DeviceID)
 	if err != nil {
 		return fmt.Errorf("failed to fetch our device: %w", err)
 	}
 
 	e.ourDevice = dev
 
-	go e.api.Gateway(context.TODO(), e.gw, dev.ID, e.cfg.ListenPort)
-	go e.handleGateway(context.TODO())
+	// Drop anything left over from an earlier connection.
+	for len(e.gw) > 0 {
+		<-e.gw
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	e.cancel = cancel
+
+	e.running.Add(2)
+	go func() {
+		defer e.running.Done()
+		a.Gateway(ctx, e.gw, dev.ID, e.cfg.ListenPort)
+	}()
+	go func() {
+		defer e.running.Done()
+		e.handleGateway(ctx)
+	}()
 
 	return nil
 }
 
+// Close disconnects from the Rendezvous server and waits for the engine to
+// stop handling messages from it.
+//
+// The Engine must not be locked by the caller.
+func (e *Engine) Close() {
+	if e.cancel != nil {
+		e.cancel()
+		e.cancel = nil
+	}
+	e.running.Wait()
+}
+
+// Reconfigure replaces the config of the engine, reconnecting to the
+// Rendezvous server with it if the engine was connected.
+//
+// If reconnecting fails, the old config is put back and the error is
+// returned.
+//
+// The Engine must not be locked by the caller.
+func (e *Engine) Reconfigure(cfg Config) error {
+	connected := e.cancel != nil
+	e.Close()
+
+	old, oldAPI := e.cfg, e.API()
+	e.cfg = cfg
+	e.api.Store(newAPI(cfg))
+	if !connected {
+		return nil
+	}
+
+	err := e.Connect()
+	if err == nil {
+		return nil
+	}
+
+	e.cfg = old
+	e.api.Store(oldAPI)
+	if err := e.Connect(); err != nil {
+		return fmt.Errorf("failed to reconnect with the old config: %w", err)
+	}
+	return err
+}
+
 // Peers returns a list of peers that this device has.
 //
 // Anything that is not a handler should lock the Engine object before
@@ -375,9 +455,18 @@ func (e *Engine) Self() *api.Device {
 	return &e.ourDevice
 }
 
+// Connected returns true if the gateway connection to the Rendezvous server is
+// currently established.
+//
+// Anything that is not a handler should lock the Engine object before
+// performing reads.
+func (e *Engine) Connected() bool {
+	return e.connected
+}
+
 // API returns the api.API object that is used by Engine.
 func (e *Engine) API() *api.API {
-	return e.api
+	return e.api.Load()
 }
 
 // OnJoin registers a function to be called upon a device joining a network.
@@ -0,0 +1,205 @@
+package piko
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mca3/pikonode/api/apitest"
+)
+
+// waitEvent waits for an event of the specified type, skipping all others.
+func waitEvent(t *testing.T, evs <-chan Event, typ EventType) Event {
+	t.Helper()
+
+	timeout := time.After(time.Second * 5)
+	for {
+		select {
+		case ev := <-evs:
+			if ev.Type == typ {
+				return ev
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %v", typ)
+		}
+	}
+}
+
+func TestEngine(t *testing.T) {
+	srv := apitest.NewServer()
+	defer srv.Close()
+
+	u, token := srv.AddUser("alice", "hunter2")
+	self := srv.AddDevice(u.ID, "self", "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=")
+	peer := srv.AddDevice(u.ID, "peer", "BAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=")
+	nw := srv.AddNetwork(u.ID, "home")
+	srv.Join(self.ID, nw.ID)
+
+	e, err := NewEngine(Config{
+		Rendezvous: srv.URL(),
+		Token:      token,
+		DeviceID:   self.ID,
+	})
+	if err != nil {
+		t.Fatalf("NewEngine = %v", err)
+	}
+
+	evs, unsubscribe := e.Subscribe(16)
+	defer unsubscribe()
+
+	if err := e.Connect(); err != nil {
+		t.Fatalf("Connect = %v", err)
+	}
+
+	waitEvent(t, evs, EventConnect)
+	waitEvent(t, evs, EventRebuild)
+
+	e.Lock()
+	if len(e.Networks()) != 1 || len(e.Peers()) != 0 {
+		t.Errorf("got %d networks and %d peers, expected 1 and 0", len(e.Networks()), len(e.Peers()))
+	}
+	e.Unlock()
+
+	srv.Join(peer.ID, nw.ID)
+	if ev := waitEvent(t, evs, EventJoin); ev.Device.ID != peer.ID {
+		t.Errorf("join event for device %d, expected %d", ev.Device.ID, peer.ID)
+	}
+
+	e.Lock()
+	if p := e.Peers(); len(p) != 1 || p[0].ID != peer.ID {
+		t.Errorf("Peers() = %v, expected only %d", p, peer.ID)
+	}
+	e.Unlock()
+
+	peer.Name = "renamed"
+	srv.UpdateDevice(peer)
+	waitEvent(t, evs, EventUpdate)
+
+	e.Lock()
+	if p := e.Peers(); len(p) != 1 || p[0].Name != "renamed" {
+		t.Errorf("Peers() = %v, expected peer to be renamed", p)
+	}
+	e.Unlock()
+
+	srv.Leave(peer.ID, nw.ID)
+	waitEvent(t, evs, EventLeave)
+
+	e.Lock()
+	if p := e.Peers(); len(p) != 0 {
+		t.Errorf("Peers() = %v, expected none", p)
+	}
+	e.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	srv.DisconnectGateways()
+	if ev := waitEvent(t, evs, EventDisconnect); ev.Delay <= 0 {
+		t.Errorf("disconnect event has delay %v", ev.Delay)
+	}
+
+	// The engine should come back on its own.
+	if err := srv.WaitGateways(ctx, 1); err != nil {
+		t.Errorf("engine did not reconnect: %v", err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	srv := apitest.NewServer()
+	defer srv.Close()
+
+	u, token := srv.AddUser("alice", "hunter2")
+	self := srv.AddDevice(u.ID, "self", "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=")
+
+	e, err := NewEngine(Config{
+		Rendezvous: srv.URL(),
+		Token:      token,
+		DeviceID:   self.ID,
+	})
+	if err != nil {
+		t.Fatalf("NewEngine = %v", err)
+	}
+
+	// Closing an engine that never connected does nothing.
+	e.Close()
+
+	evs, unsubscribe := e.Subscribe(16)
+	defer unsubscribe()
+
+	if err := e.Connect(); err != nil {
+		t.Fatalf("Connect = %v", err)
+	}
+	waitEvent(t, evs, EventConnect)
+
+	done := make(chan struct{})
+	go func() {
+		e.Close()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatalf("Close did not return")
+	}
+}
+
+func TestReconfigure(t *testing.T) {
+	srv := apitest.NewServer()
+	defer srv.Close()
+
+	other := apitest.NewServer()
+	defer other.Close()
+
+	u, token := srv.AddUser("alice", "hunter2")
+	self := srv.AddDevice(u.ID, "self", "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=")
+
+	ou, otherToken := other.AddUser("bob", "hunter2")
+	otherSelf := other.AddDevice(ou.ID, "self", "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=")
+
+	cfg := Config{
+		Rendezvous: srv.URL(),
+		Token:      token,
+		DeviceID:   self.ID,
+	}
+	e, err := NewEngine(cfg)
+	if err != nil {
+		t.Fatalf("NewEngine = %v", err)
+	}
+	defer e.Close()
+
+	evs, unsubscribe := e.Subscribe(16)
+	defer unsubscribe()
+
+	if err := e.Connect(); err != nil {
+		t.Fatalf("Connect = %v", err)
+	}
+	waitEvent(t, evs, EventConnect)
+
+	// A bad token is rejected, and the engine stays with the old server.
+	bad := cfg
+	bad.Rendezvous, bad.Token = other.URL(), "nope"
+	if err := e.Reconfigure(bad); err == nil {
+		t.Errorf("Reconfigure with a bad token succeeded")
+	}
+	if e.API().Server != srv.URL() {
+		t.Errorf("engine uses %s after failing to reconfigure, expected %s", e.API().Server, srv.URL())
+	}
+	waitEvent(t, evs, EventConnect)
+
+	good := Config{
+		Rendezvous: other.URL(),
+		Token:      otherToken,
+		DeviceID:   otherSelf.ID,
+	}
+	if err := e.Reconfigure(good); err != nil {
+		t.Fatalf("Reconfigure = %v", err)
+	}
+	waitEvent(t, evs, EventConnect)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if err := other.WaitGateways(ctx, 1); err != nil {
+		t.Errorf("engine did not connect to the new server: %v", err)
+	}
+}
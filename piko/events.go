@@ -0,0 +1,159 @@
+package piko
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mca3/pikonode/api"
+)
+
+// EventType is the type of an Event.
+type EventType int
+
+const (
+	// EventJoin is sent when a device joins a network.
+	// Network and Device are set.
+	EventJoin EventType = iota
+
+	// EventLeave is sent when a device leaves a network.
+	// Network and Device are set.
+	EventLeave
+
+	// EventUpdate is sent when a device updates its information.
+	// Device is set.
+	EventUpdate
+
+	// EventRebuild is sent after the internal state has been fully
+	// rebuilt.
+	EventRebuild
+
+	// EventConnect is sent when the gateway connection to the Rendezvous
+	// server is established.
+	EventConnect
+
+	// EventDisconnect is sent when the gateway connection to the
+	// Rendezvous server is lost or could not be established.
+	// Delay and Error are set.
+	EventDisconnect
+)
+
+// Event describes a change in the state of the Engine.
+type Event struct {
+	Type EventType
+
+	Network *api.Network
+	Device  *api.Device
+
+	// Delay is the amount of time until the next reconnection attempt.
+	Delay time.Duration
+
+	// Error is the reason the gateway connection was lost, if any.
+	Error error
+
+	// Dropped is the number of events that were dropped right before this
+	// one because the subscriber was not keeping up.
+	//
+	// When Dropped is non-zero, the subscriber should consider its view of
+	// the Engine to be stale and read it again.
+	Dropped int
+}
+
+// String returns the name of the event type.
+func (t EventType) String() string {
+	switch t {
+	case EventJoin:
+		return "join"
+	case EventLeave:
+		return "leave"
+	case EventUpdate:
+		return "update"
+	case EventRebuild:
+		return "rebuild"
+	case EventConnect:
+		return "connect"
+	case EventDisconnect:
+		return "disconnect"
+	}
+
+	return "unknown"
+}
+
+// subscriber holds the state of a single call to Subscribe.
+type subscriber struct {
+	ch      chan Event
+	dropped int
+}
+
+// subscribers holds all channels returned by Subscribe.
+//
+// This has its own lock so that subscribing and unsubscribing are possible
+// from inside of handlers, which are called with the Engine locked.
+type subscribers struct {
+	subs map[*subscriber]struct{}
+	mu   sync.Mutex
+}
+
+// Subscribe returns a channel on which every event that happens on the Engine
+// is delivered, and a function that stops delivery and closes the channel.
+//
+// size is the number of events that will be buffered for the subscriber.
+// Events are never waited on; if the buffer is full, the event is dropped and
+// the number of dropped events is reported in the next event that is
+// delivered.
+//
+// Unlike handlers, events are read without holding the Engine lock.
+// Lock the Engine before reading any state in response to an event.
+func (e *Engine) Subscribe(size int) (<-chan Event, func()) {
+	if size < 1 {
+		size = 1
+	}
+
+	s := &subscriber{ch: make(chan Event, size)}
+
+	e.subs.mu.Lock()
+	if e.subs.subs == nil {
+		e.subs.subs = map[*subscriber]struct{}{}
+	}
+	e.subs.subs[s] = struct{}{}
+	e.subs.mu.Unlock()
+
+	once := sync.Once{}
+	return s.ch, func() {
+		once.Do(func() {
+			e.subs.mu.Lock()
+			defer e.subs.mu.Unlock()
+
+			delete(e.subs.subs, s)
+			close(s.ch)
+		})
+	}
+}
+
+// emit delivers an event to all subscribers.
+func (e *Engine) emit(ev Event) {
+	// Nobody may modify these behind our backs.
+	if ev.Network != nil {
+		nw := *ev.Network
+		nw.Devices = append([]api.Device(nil), nw.Devices...)
+		ev.Network = &nw
+	}
+	if ev.Device != nil {
+		dev := *ev.Device
+		ev.Device = &dev
+	}
+
+	e.subs.mu.Lock()
+	defer e.subs.mu.Unlock()
+
+	for s := range e.subs.subs {
+		sev := ev
+		sev.Dropped = s.dropped
+
+		select {
+		case s.ch <- sev:
+			s.dropped = 0
+		default:
+			s.dropped++
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package piko
+
+import (
+	"testing"
+
+	"github.com/mca3/pikonode/api"
+)
+
+func TestSubscribe(t *testing.T) {
+	e, _ := NewEngine(Config{})
+
+	evs, unsubscribe := e.Subscribe(2)
+
+	dev := &api.Device{ID: 1, Name: "first"}
+	e.emit(Event{Type: EventUpdate, Device: dev})
+	dev.Name = "changed"
+
+	ev := <-evs
+	if ev.Type != EventUpdate || ev.Device.Name != "first" {
+		t.Errorf("got %v %+v, expected update for \"first\"", ev.Type, ev.Device)
+	}
+
+	nw := &api.Network{ID: 1, Devices: []api.Device{{ID: 1, Name: "first"}}}
+	e.emit(Event{Type: EventJoin, Network: nw, Device: &nw.Devices[0]})
+	nw.Devices[0].Name = "changed"
+
+	if ev := <-evs; ev.Network.Devices[0].Name != "first" {
+		t.Errorf("network in event has %+v, expected a copy of its devices", ev.Network.Devices)
+	}
+
+	// Overflow the buffer.
+	for i := 0; i < 5; i++ {
+		e.emit(Event{Type: EventRebuild})
+	}
+
+	<-evs
+	<-evs
+
+	e.emit(Event{Type: EventConnect})
+	if ev := <-evs; ev.Type != EventConnect || ev.Dropped != 3 {
+		t.Errorf("got %v with %d dropped, expected connect with 3 dropped", ev.Type, ev.Dropped)
+	}
+
+	unsubscribe()
+	unsubscribe()
+
+	if _, ok := <-evs; ok {
+		t.Errorf("channel not closed after unsubscribing")
+	}
+
+	// Must not panic.
+	e.emit(Event{Type: EventConnect})
+}